@@ -0,0 +1,218 @@
+// Package config loads service settings. Settings come from built-in
+// defaults, then from an optional YAML file, then from environment variables.
+// Every next source overrides the previous one.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	// Address the HTTP server listens on. Env: LISTEN_ADDR.
+	Listen string `yaml:"listen"`
+
+	// How long to wait for in-flight requests on SIGINT or SIGTERM before
+	// cutting them. Env: SHUTDOWN_TIMEOUT.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	Database Database `yaml:"database"`
+}
+
+type Database struct {
+	// Full connection string, either a URL or key=value pairs. If set, the
+	// connection fields below are ignored. Env: DATABASE_URL.
+	URL string `yaml:"url"`
+
+	Host     string `yaml:"host"`     // Env: DB_HOST.
+	Port     int    `yaml:"port"`     // Env: DB_PORT.
+	Name     string `yaml:"name"`     // Env: DB_NAME.
+	User     string `yaml:"user"`     // Env: DB_USER.
+	Password string `yaml:"password"` // Env: DB_PASSWORD.
+	SSLMode  string `yaml:"sslmode"`  // Env: DB_SSLMODE.
+
+	// Open connections at most. Zero means no limit. Env: DB_MAX_OPEN_CONNS.
+	MaxOpenConns int `yaml:"max_open_conns"`
+
+	// Idle connections kept for reuse, 2 by default. Zero keeps none, so
+	// every query opens a new connection. Env: DB_MAX_IDLE_CONNS.
+	MaxIdleConns int `yaml:"max_idle_conns"`
+
+	// How long a connection may be reused. Zero means forever.
+	// Env: DB_CONN_MAX_LIFETIME.
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
+
+	// Postgres' statement_timeout for every connection. Zero means the
+	// server default. Env: DB_STATEMENT_TIMEOUT.
+	StatementTimeout time.Duration `yaml:"statement_timeout"`
+
+	// Apply pending migrations when the server starts. Disable it to run
+	// `migrate up` separately. Env: DB_AUTO_MIGRATE.
+	AutoMigrate bool `yaml:"auto_migrate"`
+}
+
+// Default returns the settings matching docker-compose.yml.
+func Default() Config {
+	return Config{
+		Listen:          ":8080",
+		ShutdownTimeout: 30 * time.Second,
+		Database: Database{
+			Host:         "postgres",
+			Port:         5432,
+			Name:         "postgres",
+			User:         "postgres",
+			Password:     "password",
+			SSLMode:      "disable",
+			MaxIdleConns: 2,
+			AutoMigrate:  true,
+		},
+	}
+}
+
+// Load reads the YAML file at path, if path is not empty, and applies
+// environment variables on top of it.
+func Load(path string) (Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if err = yaml.Unmarshal(contents, &cfg); err != nil {
+			return cfg, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+
+	return cfg, cfg.fromEnv()
+}
+
+func (cfg *Config) fromEnv() error {
+	db := &cfg.Database
+
+	envString("LISTEN_ADDR", &cfg.Listen)
+	envString("DATABASE_URL", &db.URL)
+	envString("DB_HOST", &db.Host)
+	envString("DB_NAME", &db.Name)
+	envString("DB_USER", &db.User)
+	envString("DB_PASSWORD", &db.Password)
+	envString("DB_SSLMODE", &db.SSLMode)
+
+	if err := envDuration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout); err != nil {
+		return err
+	}
+	if err := envInt("DB_PORT", &db.Port); err != nil {
+		return err
+	}
+	if err := envInt("DB_MAX_OPEN_CONNS", &db.MaxOpenConns); err != nil {
+		return err
+	}
+	if err := envInt("DB_MAX_IDLE_CONNS", &db.MaxIdleConns); err != nil {
+		return err
+	}
+	if err := envDuration("DB_CONN_MAX_LIFETIME", &db.ConnMaxLifetime); err != nil {
+		return err
+	}
+	if err := envDuration("DB_STATEMENT_TIMEOUT", &db.StatementTimeout); err != nil {
+		return err
+	}
+	return envBool("DB_AUTO_MIGRATE", &db.AutoMigrate)
+}
+
+func envString(key string, dst *string) {
+	if val, ok := os.LookupEnv(key); ok {
+		*dst = val
+	}
+}
+
+func envInt(key string, dst *int) error {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = n
+	return nil
+}
+
+func envBool(key string, dst *bool) error {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = b
+	return nil
+}
+
+func envDuration(key string, dst *time.Duration) error {
+	val, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	*dst = d
+	return nil
+}
+
+// DSN returns the connection string for lib/pq.
+func (d Database) DSN() (string, error) {
+	// lib/pq passes unknown parameters to the server as run-time settings,
+	// which is how statement_timeout gets set for every connection.
+	timeout := ""
+	if d.StatementTimeout > 0 {
+		timeout = strconv.FormatInt(d.StatementTimeout.Milliseconds(), 10)
+	}
+
+	if d.URL != "" {
+		if timeout == "" {
+			return d.URL, nil
+		}
+		if !strings.HasPrefix(d.URL, "postgres://") && !strings.HasPrefix(d.URL, "postgresql://") {
+			return d.URL + " statement_timeout=" + timeout, nil
+		}
+		u, err := url.Parse(d.URL)
+		if err != nil {
+			return "", fmt.Errorf("DATABASE_URL: %w", err)
+		}
+		q := u.Query()
+		q.Set("statement_timeout", timeout)
+		u.RawQuery = q.Encode()
+		return u.String(), nil
+	}
+
+	pairs := []string{
+		"host=" + quote(d.Host),
+		"port=" + strconv.Itoa(d.Port),
+		"dbname=" + quote(d.Name),
+		"user=" + quote(d.User),
+		"password=" + quote(d.Password),
+		"sslmode=" + quote(d.SSLMode),
+	}
+	if timeout != "" {
+		pairs = append(pairs, "statement_timeout="+timeout)
+	}
+	return strings.Join(pairs, " "), nil
+}
+
+// quote escapes a value for the key=value connection string format.
+func quote(val string) string {
+	val = strings.ReplaceAll(val, `\`, `\\`)
+	val = strings.ReplaceAll(val, `'`, `\'`)
+	return "'" + val + "'"
+}
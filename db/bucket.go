@@ -0,0 +1,37 @@
+package db
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+)
+
+// Buckets split users of segments with a salt. A user is in such a segment if
+// their bucket is less than the automatic percent times buckets / 100.
+const buckets = 10_000
+
+// Bucket returns the bucket of the user in segments with the given salt. It is
+// the first 4 bytes of md5 of "salt:user_id" as a big-endian unsigned number,
+// modulo 10000. The same user always gets the same bucket, so raising the
+// percent only adds users. Function segment_bucket in the database is the same,
+// and clients can compute it too.
+func Bucket(salt string, userId int) int {
+	sum := md5.Sum([]byte(salt + ":" + strconv.Itoa(userId)))
+	return int(binary.BigEndian.Uint32(sum[:4]) % buckets)
+}
+
+// inBucket tells if the user is in the segment with the given salt and percent.
+func inBucket(salt string, percent uint, userId int) bool {
+	return Bucket(salt, userId) < int(percent)*buckets/100
+}
+
+// NewSalt returns a random salt for a new segment.
+func NewSalt() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
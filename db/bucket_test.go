@@ -0,0 +1,20 @@
+package db
+
+import "testing"
+
+// The vectors pin the hash. Clients and segment_bucket compute the same.
+func TestBucket(t *testing.T) {
+	for _, test := range []struct {
+		salt   string
+		userId int
+		bucket int
+	}{
+		{"abc", 1000, 9762},
+		{"AVITO_VOICE_MESSAGES", 1, 4864},
+		{"salt", -5, 5712},
+	} {
+		if got := Bucket(test.salt, test.userId); got != test.bucket {
+			t.Errorf("Bucket(%q, %d) = %d, want %d", test.salt, test.userId, got, test.bucket)
+		}
+	}
+}
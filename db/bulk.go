@@ -0,0 +1,494 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Formats of bulk input.
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// maxBulkFailures is how many failed rows BulkResult lists.
+const maxBulkFailures = 1000
+
+// BulkRow asks to add the user to the segment or remove them from it, like one
+// UpdateUser request with one segment.
+type BulkRow struct {
+	// Line of the input where the row starts, for failures.
+	Line int
+
+	UserId  int
+	Segment string
+
+	// OpAdd or OpRemove.
+	Op string
+
+	// Seconds before removing the user again. Only for OpAdd.
+	Ttl int
+}
+
+// BulkFailure is a row that was not applied.
+type BulkFailure struct {
+	Line int
+	Err  *Error
+}
+
+// BulkResult reports how a bulk update went.
+type BulkResult struct {
+	// Rows read.
+	Rows int
+
+	// Rows applied. The rest failed.
+	Applied int
+
+	// Rows failed.
+	Failed int
+
+	// Failures ordered by line. At most the first 1000 are here.
+	Failures []BulkFailure
+}
+
+// fail records a failed row. Only failures with the least lines are kept, see
+// done.
+func (r *BulkResult) fail(line int, err *Error) {
+	r.Failed++
+	r.Failures = append(r.Failures, BulkFailure{line, err})
+	if len(r.Failures) > 2*maxBulkFailures {
+		r.done()
+	}
+}
+
+// done orders failures, drops the extra ones and counts applied rows.
+func (r *BulkResult) done() {
+	sort.Slice(r.Failures, func(i, j int) bool {
+		return r.Failures[i].Line < r.Failures[j].Line
+	})
+	if len(r.Failures) > maxBulkFailures {
+		r.Failures = r.Failures[:maxBulkFailures]
+	}
+	r.Applied = r.Rows - r.Failed
+}
+
+// BulkReader reads bulk rows. CSV has columns user_id, segment, op and
+// optional ttl, and might start with a header. NDJSON has an object with the
+// same fields on every line.
+type BulkReader struct {
+	next func() (BulkRow, error)
+}
+
+func NewBulkReader(r io.Reader, format string) (*BulkReader, error) {
+	switch format {
+	case FormatCSV:
+		return &BulkReader{next: csvRows(r)}, nil
+	case FormatNDJSON:
+		return &BulkReader{next: ndjsonRows(r)}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// Next returns the next row, or io.EOF after the last one. If the row is
+// malformed, the error is an *Error and the row has only the line set. Reading
+// goes on after such errors, but not after others.
+func (b *BulkReader) Next() (BulkRow, error) {
+	return b.next()
+}
+
+func csvRows(r io.Reader) func() (BulkRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.ReuseRecord = true
+
+	first := true
+	return func() (BulkRow, error) {
+		for {
+			record, err := reader.Read()
+			var parseErr *csv.ParseError
+			switch {
+			case errors.As(err, &parseErr):
+				return BulkRow{Line: parseErr.StartLine}, ErrBadRow.blame("", "")
+			case err != nil:
+				return BulkRow{}, err
+			}
+			line, _ := reader.FieldPos(0)
+			if first && record[0] == "user_id" {
+				first = false
+				continue // A header
+			}
+			first = false
+
+			if len(record) < 3 || len(record) > 4 {
+				return BulkRow{Line: line}, ErrBadRow.blame("", "")
+			}
+			ttl := "0"
+			if len(record) == 4 && record[3] != "" {
+				ttl = record[3]
+			}
+			return parseRow(line, record[0], record[1], record[2], ttl)
+		}
+	}
+}
+
+func ndjsonRows(r io.Reader) func() (BulkRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+
+	line := 0
+	return func() (BulkRow, error) {
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+
+			var row struct {
+				UserId  *json.Number `json:"user_id"`
+				Segment string       `json:"segment"`
+				Op      string       `json:"op"`
+				Ttl     *json.Number `json:"ttl"`
+			}
+			if err := json.Unmarshal([]byte(text), &row); err != nil {
+				return BulkRow{Line: line}, ErrBadRow.blame("", "")
+			}
+			userId, ttl := "", "0"
+			if row.UserId != nil {
+				userId = row.UserId.String()
+			}
+			if row.Ttl != nil {
+				ttl = row.Ttl.String()
+			}
+			return parseRow(line, userId, row.Segment, row.Op, ttl)
+		}
+		if err := scanner.Err(); err != nil {
+			return BulkRow{}, err
+		}
+		return BulkRow{}, io.EOF
+	}
+}
+
+func parseRow(line int, userId, segment, op, ttl string) (BulkRow, error) {
+	row := BulkRow{Line: line, Segment: segment, Op: op}
+	id, err := strconv.ParseInt(userId, 10, 32)
+	if err != nil {
+		return BulkRow{Line: line}, ErrBadRow.blame("user_id", segment)
+	}
+	row.UserId = int(id)
+	if op != OpAdd && op != OpRemove {
+		return BulkRow{Line: line}, ErrBadRow.blame("op", segment)
+	}
+	seconds, err := strconv.ParseInt(ttl, 10, 32)
+	if err != nil || seconds < 0 || seconds > 0 && op == OpRemove {
+		return BulkRow{Line: line}, ErrBadRow.blame("ttl", segment)
+	}
+	row.Ttl = int(seconds)
+	return row, nil
+}
+
+func (s *Store) UpdateUsers(ctx context.Context, rows *BulkReader) (BulkResult, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return BulkResult{}, err
+	}
+	defer tx.Rollback()
+
+	// Rows go to a staging table as they are read, then everything is done
+	// set-wise in the same order as UpdateUser does.
+	const (
+		qStage = `
+create temp table bulk_rows (
+   line    integer,
+   user_id integer,
+   segment text,
+   op      text,
+   ttl     integer
+) on commit drop;
+`
+		qFailures = `
+select b.line, b.segment, s.id is not null, count(*) over ()
+from bulk_rows b
+left join segments s on s.name = b.segment
+where s.id is null or coalesce(s.deleted, false)
+order by b.line
+limit $1;
+`
+		qOps = `
+create temp table bulk_ops on commit drop as
+select distinct on (b.user_id, s.id) b.user_id, s.id as segment_id, b.op, b.ttl
+from bulk_rows b
+join segments s on s.name = b.segment and not coalesce(s.deleted, false)
+order by b.user_id, s.id, b.line desc; -- The last row for a membership wins
+`
+		qAnalyze = `analyze bulk_ops;`
+		qAdd     = `
+with adds as (
+   select user_id, segment_id,
+      (case when ttl > 0 then 'ttl' else 'explicit' end)::membership_source as source
+   from bulk_ops
+   where op = 'add'
+), requested as ( -- Same as in qAddToSegment
+   update users_to_segments uts
+   set source = adds.source
+   from adds
+   where uts.user_id = adds.user_id and uts.segment_id = adds.segment_id
+     and (uts.source = 'automatic' or adds.source = 'ttl')
+), insertions as (
+   insert into users_to_segments (user_id, segment_id, source)
+   select user_id, segment_id, source
+   from adds
+   on conflict do nothing
+   returning user_id, segment_id, source
+)
+insert into operation_history (user_id, segment_id, operation, source)
+select user_id, segment_id, 'add', source
+from insertions;
+`
+		qPlan = `
+with plans as (
+   insert into scheduled_operations (stamp, user_id, segment_id, operation, source)
+   select $1::timestamptz + ttl * interval '1 second', user_id, segment_id, 'remove', 'ttl'
+   from bulk_ops
+   where op = 'add' and ttl > 0
+   on conflict (user_id, segment_id, operation) do update -- Like in planRemoval
+   set stamp = excluded.stamp, source = excluded.source
+   returning stamp
+)
+select distinct stamp from plans
+order by stamp
+limit $2;
+`
+		qInfect = `
+with users as ( -- One random value per user, like in qInfect
+   select user_id, random() * 100.0 as xi
+   from (select distinct user_id from bulk_ops) distinct_users
+), bonus as (
+   select users.user_id, s.id as segment_id
+   from users
+   cross join segments s
+   where s.deleted = false and case
+      when s.salt is null then xi <= s.automatic_percent or s.automatic_percent = 100
+      else segment_bucket(s.salt, users.user_id) < s.automatic_percent * 100
+   end
+), insertions as (
+   insert into users_to_segments (user_id, segment_id, source)
+   select user_id, segment_id, 'automatic'
+   from bonus
+   on conflict do nothing
+   returning user_id, segment_id
+)
+insert into operation_history (user_id, segment_id, operation, source)
+select user_id, segment_id, 'add', 'automatic'
+from insertions;
+`
+		qRemove = `
+with deletions as (
+   delete from users_to_segments uts
+   using bulk_ops b
+   where b.op = 'remove' and uts.user_id = b.user_id and uts.segment_id = b.segment_id
+   returning uts.user_id, uts.segment_id
+)
+insert into operation_history (user_id, segment_id, operation, source)
+select user_id, segment_id, 'remove', 'explicit'
+from deletions;
+`
+	)
+
+	if _, err = tx.ExecContext(ctx, qStage); err != nil {
+		return BulkResult{}, err
+	}
+	result, err := copyRows(ctx, tx, rows)
+	if err != nil {
+		return BulkResult{}, err
+	}
+
+	failures, err := tx.QueryContext(ctx, qFailures, maxBulkFailures)
+	if err != nil {
+		return BulkResult{}, err
+	}
+	defer failures.Close()
+	var selected, total int
+	for failures.Next() {
+		var (
+			line    int
+			segment string
+			deleted bool
+		)
+		if err = failures.Scan(&line, &segment, &deleted, &total); err != nil {
+			return BulkResult{}, err
+		}
+		if deleted {
+			result.fail(line, ErrSegmentDeleted.blame("segment", segment))
+		} else {
+			result.fail(line, ErrNameFree.blame("segment", segment))
+		}
+		selected++
+	}
+	if err = failures.Err(); err != nil {
+		return BulkResult{}, err
+	}
+	// Only the first failures are selected, but all of them count.
+	result.Failed += total - selected
+
+	for _, q := range []string{qOps, qAnalyze, qAdd} {
+		if _, err = tx.ExecContext(ctx, q); err != nil {
+			return BulkResult{}, err
+		}
+	}
+
+	// The schedule does not need every plan, a reminder for each moment is
+	// enough: it removes everything due at once.
+	plans, err := tx.QueryContext(ctx, qPlan, time.Now(), scheduleCapacity)
+	if err != nil {
+		return BulkResult{}, err
+	}
+	defer plans.Close()
+	var reminders []plannedTask
+	for plans.Next() {
+		var task plannedTask
+		if err = plans.Scan(&task.stamp); err != nil {
+			return BulkResult{}, err
+		}
+		reminders = append(reminders, task)
+	}
+	if err = plans.Err(); err != nil {
+		return BulkResult{}, err
+	}
+
+	for _, q := range []string{qInfect, qRemove} {
+		if _, err = tx.ExecContext(ctx, q); err != nil {
+			return BulkResult{}, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return BulkResult{}, err
+	}
+	s.schedule.plan(reminders...)
+	result.done()
+	return result, nil
+}
+
+// copyRows copies rows to bulk_rows and records malformed ones.
+func copyRows(ctx context.Context, tx *sql.Tx, rows *BulkReader) (BulkResult, error) {
+	var result BulkResult
+	stmt, err := tx.PrepareContext(ctx, pq.CopyIn("bulk_rows", "line", "user_id", "segment", "op", "ttl"))
+	if err != nil {
+		return result, err
+	}
+	defer stmt.Close()
+
+	for {
+		row, err := rows.Next()
+		var e *Error
+		switch {
+		case errors.Is(err, io.EOF):
+			_, err = stmt.ExecContext(ctx) // Flush
+			return result, err
+		case errors.As(err, &e):
+			result.Rows++
+			result.fail(row.Line, e)
+			continue
+		case err != nil:
+			return result, err
+		}
+		result.Rows++
+		if _, err = stmt.ExecContext(ctx, row.Line, row.UserId, row.Segment, row.Op, row.Ttl); err != nil {
+			return result, err
+		}
+	}
+}
+
+func (m *MemoryStore) UpdateUsers(_ context.Context, rows *BulkReader) (BulkResult, error) {
+	var (
+		result BulkResult
+		staged []BulkRow
+	)
+	for {
+		row, err := rows.Next()
+		var e *Error
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		switch {
+		case errors.As(err, &e):
+			result.Rows++
+			result.fail(row.Line, e)
+			continue
+		case err != nil:
+			return BulkResult{}, err
+		}
+		result.Rows++
+		staged = append(staged, row)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Same steps as Store: failures, the last row per membership, additions,
+	// plans, automatic segments, removals.
+	last := map[membership]BulkRow{}
+	for _, row := range staged {
+		segment, err := m.segment("segment", row.Segment)
+		if err != nil {
+			result.fail(row.Line, err.(*Error))
+			continue
+		}
+		key := membership{row.UserId, segment.id}
+		if prev, ok := last[key]; !ok || prev.Line < row.Line {
+			last[key] = row
+		}
+	}
+	keys := make([]membership, 0, len(last))
+	for key := range last {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].userId != keys[j].userId {
+			return keys[i].userId < keys[j].userId
+		}
+		return keys[i].segmentId < keys[j].segmentId
+	})
+
+	now := m.schedule.clock.Now()
+	for _, key := range keys {
+		switch row := last[key]; {
+		case row.Op == OpAdd && row.Ttl > 0:
+			m.add(key.userId, key.segmentId, SourceTTL)
+		case row.Op == OpAdd:
+			m.add(key.userId, key.segmentId, SourceExplicit)
+		}
+	}
+	for _, key := range keys {
+		if row := last[key]; row.Op == OpAdd && row.Ttl > 0 {
+			m.planRemoval(now.Add(time.Duration(row.Ttl)*time.Second), key.userId, key.segmentId)
+		}
+	}
+	for i, key := range keys {
+		if i == 0 || keys[i-1].userId != key.userId {
+			m.infect(key.userId)
+		}
+	}
+	for _, key := range keys {
+		if last[key].Op == OpRemove {
+			m.remove(key.userId, key.segmentId, SourceExplicit)
+		}
+	}
+
+	result.done()
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBulkReader(t *testing.T) {
+	type failure struct {
+		line  int
+		field string
+	}
+	for _, test := range []struct {
+		format   string
+		input    string
+		rows     []BulkRow
+		failures []failure
+	}{
+		{
+			FormatCSV,
+			"user_id,segment,op,ttl\n1,a,add,60\n2,\"b,c\",remove\n\n3,a,add,\n",
+			[]BulkRow{{2, 1, "a", OpAdd, 60}, {3, 2, "b,c", OpRemove, 0}, {5, 3, "a", OpAdd, 0}},
+			nil,
+		},
+		{
+			FormatCSV,
+			"x,a,add\n1,a,drop\n1,a,remove,5\n1,a\n1,\"a,add\n",
+			nil,
+			[]failure{{1, "user_id"}, {2, "op"}, {3, "ttl"}, {4, ""}, {5, ""}},
+		},
+		{
+			FormatNDJSON,
+			"{\"user_id\":1,\"segment\":\"a\",\"op\":\"add\",\"ttl\":60}\n\n{\"user_id\":2,\"segment\":\"b\",\"op\":\"remove\"}\n",
+			[]BulkRow{{1, 1, "a", OpAdd, 60}, {3, 2, "b", OpRemove, 0}},
+			nil,
+		},
+		{
+			FormatNDJSON,
+			"{\"segment\":\"a\",\"op\":\"add\"}\n{\"user_id\":1.5,\"segment\":\"a\",\"op\":\"add\"}\n{\"user_id\":1,\"segment\":\"a\",\"op\":\"add\",\"ttl\":-1}\nnot json\n",
+			nil,
+			[]failure{{1, "user_id"}, {2, "user_id"}, {3, "ttl"}, {4, ""}},
+		},
+	} {
+		reader, err := NewBulkReader(strings.NewReader(test.input), test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var (
+			rows     []BulkRow
+			failures []failure
+		)
+		for {
+			row, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			switch {
+			case errors.Is(err, ErrBadRow):
+				failures = append(failures, failure{row.Line, AsError(err).Field})
+			case err != nil:
+				t.Fatal(err)
+			default:
+				rows = append(rows, row)
+			}
+		}
+		if !reflect.DeepEqual(rows, test.rows) || !reflect.DeepEqual(failures, test.failures) {
+			t.Errorf("%s %q: got %v and failures %v, want %v and %v", test.format, test.input, rows, failures, test.rows, test.failures)
+		}
+	}
+
+	if _, err := NewBulkReader(strings.NewReader(""), "xml"); err == nil {
+		t.Error("got no error for xml")
+	}
+}
@@ -1,147 +1,151 @@
 package db
 
 import (
+	"avito2023/config"
 	"context"
 	"database/sql"
-	"encoding/csv"
 	"errors"
-	"fmt"
 	"log"
-	"strconv"
 	"strings"
-	"time"
+	"sync"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-const (
-	host     = "postgres"
-	port     = 5432
-	dbname   = "postgres"
-	user     = "postgres"
-	password = "password"
-)
+var optsRO = &sql.TxOptions{ReadOnly: true}
 
-var (
-	db *sql.DB // Run `sql/schema.sql` to initialize database.
+// Store keeps segments and their users in Postgres. The schema is in the
+// migrations directory. Create it with Open.
+type Store struct {
+	db *sql.DB
 
-	errNameEmpty      = errors.New("name empty")
-	errNameTaken      = errors.New("name taken")
-	errNameFree       = errors.New("name free")
-	errSegmentDeleted = errors.New("segment deleted")
-	errBadPercent     = errors.New("bad percent")
+	// Carries out planned operations, like removals when TTL runs out. Plans
+	// are saved in scheduled_operations first, then passed here.
+	schedule *scheduler
 
-	optsRO = &sql.TxOptions{ReadOnly: true}
-)
+	closeOnce sync.Once
+	closeErr  error
+}
 
-func init() {
-	psqlInfo := fmt.Sprintf("host=%s port=%d dbname=%s user=%s sslmode=disable password=%s", host, port, dbname, user, password)
-	var err error
-	db, err = sql.Open("postgres", psqlInfo)
+// connect opens a connection pool and makes sure the database is reachable.
+func connect(ctx context.Context, cfg config.Database) (*sql.DB, error) {
+	dsn, err := cfg.DSN()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	err = db.Ping()
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	if err = db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
 	}
-	startSchedule()
+	return db, nil
 }
 
-func Close() {
-	err := db.Close()
+// Open connects to the database described by cfg, applies pending migrations
+// if cfg.AutoMigrate is set, and starts the schedule.
+func Open(ctx context.Context, cfg config.Database) (*Store, error) {
+	db, err := connect(ctx, cfg)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+
+	if cfg.AutoMigrate {
+		if err = migrateUp(ctx, db); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+
+	s := &Store{db: db}
+	s.schedule = newScheduler(s, realClock{}, scheduleCapacity)
+	if err = s.schedule.start(ctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close stops the schedule, waits for the running operations to finish and
+// closes the database. Planned operations stay in the database and are picked up
+// by the next Open. Only the first call does that, later ones return its result.
+func (s *Store) Close() error {
+	s.closeOnce.Do(func() {
+		s.schedule.close()
+		s.closeErr = s.db.Close()
+	})
+	return s.closeErr
 }
 
-func CreateSegment(ctx context.Context, name string, percent uint) error {
+func (s *Store) CreateSegment(ctx context.Context, name string, percent uint, salt string, meta SegmentMeta) error {
 	if name == "" {
-		return errNameEmpty
+		return ErrNameEmpty.blame("name", "")
 	}
-	tx, err := db.BeginTx(ctx, nil)
+	meta, err := meta.normalize(name)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	if percent < 0 || percent > 100 {
-		return errBadPercent
+		return ErrBadPercent.blame("percent", name)
 	}
 
-	const qCreate = `insert into segments (name, automatic_percent) values ($1, $2);`
-	_, err = tx.ExecContext(ctx, qCreate, name, percent)
+	const qCreate = `
+insert into segments (name, automatic_percent, salt, description, owner, tags, attributes)
+values ($1, $2, $3, $4, $5, $6, $7)
+returning id;
+`
+	var id int
+	err = tx.QueryRowContext(ctx, qCreate,
+		name, percent, sql.NullString{String: salt, Valid: salt != ""},
+		meta.Description, meta.Owner, pq.Array(meta.Tags), string(meta.Attributes),
+	).Scan(&id)
 
 	// When we try to write an existing name, the following error is returned:
 	//     pq: duplicate key value violates unique constraint "segments_name_key"
 	// We parse the error message post factum instead of checking if the name is
 	// free beforehand to make one less round trip.
 	if err != nil && strings.Contains(err.Error(), "duplicate key") {
-		return errNameTaken
+		return ErrNameTaken.blame("name", name)
 	} else if err != nil {
 		return err
 	}
 
-	if percent > 0 {
-		const qRetro = `
-with percented(user_id, percent_rank) as ( -- Get user with percent value
-   select distinct (user_id), percent_rank() over (order by random())
-   from users_to_segments
-), sample as ( -- Get $1 % users according to the percent rank
-   select user_id from percented
-   where percent_rank < ($2 / 100.0) -- .0 required to avoid rounding to zero
-), records_to_write as ( -- Prepare new records for insertion
-	select user_id, segments.id as segment_id
-	from sample
-	join segments on true
-	where segments.name = $1 and segments.deleted = false
-), written_records as ( -- Not all records were written.
-   insert into users_to_segments (user_id, segment_id)
-	select user_id, segment_id
-	from records_to_write
-	on conflict do nothing -- Got an explicit entry like that? Whatever, move on.
-   returning user_id, segment_id
-)
-insert into operation_history (user_id, segment_id, operation)
-select user_id, segment_id, 'add'
-from written_records;
-`
-		if _, err = tx.ExecContext(ctx, qRetro, name, percent); err != nil {
-			return err
-		}
+	// Known users get into the segment with the same probability as new ones.
+	if err = ramp(ctx, tx, id, salt, 0, percent); err != nil {
+		return err
 	}
 
 	return tx.Commit()
 }
 
-func DeleteSegment(ctx context.Context, name string) error {
-	tx, err := db.BeginTx(ctx, nil)
+func (s *Store) DeleteSegment(ctx context.Context, name string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	// Check if segment is actually deletable.
-	const qInfo = `select id, deleted from segments where name = $1;`
-	row := tx.QueryRowContext(ctx, qInfo, name)
-
-	var (
-		id      int
-		deleted bool
-	)
-	err = row.Scan(&id, &deleted)
-	switch {
-	case errors.Is(err, sql.ErrNoRows):
-		return errNameFree
-	case err != nil:
+	id, err := activeSegmentId(ctx, tx, "name", name)
+	if err != nil {
 		return err
-	case deleted:
-		return errSegmentDeleted
 	}
 
 	// OK. We can delete now.
-	const qMarkDeletion = `update segments set deleted = true where id = $1;`
+	const qMarkDeletion = `update segments set deleted = true, deleted_at = now() where id = $1;`
 	_, err = tx.ExecContext(ctx, qMarkDeletion, id)
 	if err != nil {
 		return err
@@ -153,26 +157,57 @@ func DeleteSegment(ctx context.Context, name string) error {
 		return err
 	}
 
+	// The schedule might still have the plans. It ignores missing ones.
+	const qForgetPlans = `delete from scheduled_operations where segment_id = $1;`
+	_, err = tx.ExecContext(ctx, qForgetPlans, id)
+	if err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
-func UpdateUser(ctx context.Context, userId int, addTo []string, removeFrom []string, ttl int) error {
-	tx, err := db.BeginTx(ctx, nil)
+// activeSegmentId returns the id of the segment, which must not be deleted.
+// Errors blame the segment in the field.
+func activeSegmentId(ctx context.Context, tx *sql.Tx, field, name string) (int, error) {
+	const qSegmentIdByName = `select id, deleted from segments where name = $1;`
+	var (
+		id      int
+		deleted bool
+	)
+	switch err := tx.QueryRowContext(ctx, qSegmentIdByName, name).Scan(&id, &deleted); {
+	case errors.Is(err, sql.ErrNoRows):
+		log.Printf("Didn't find id for segment %s\n", name)
+		return 0, ErrNameFree.blame(field, name)
+	case err != nil:
+		return 0, err
+	case deleted:
+		return 0, ErrSegmentDeleted.blame(field, name)
+	}
+	return id, nil
+}
+
+func (s *Store) UpdateUser(ctx context.Context, userId int, addTo []string, removeFrom []string, ttl int, plans ...Plan) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
 	const (
-		qSegmentIdByName = `select id, deleted from segments where name = $1;`
-		qAddToSegment    = `
-with insertions as (
-   insert into users_to_segments (user_id, segment_id)
-   values ($1, $2)
+		qAddToSegment = `
+with requested as ( -- Got there automatically? Now it is by request.
+   update users_to_segments
+   set source = $3
+   where user_id = $1 and segment_id = $2 and (source = 'automatic' or $3 = 'ttl')
+), insertions as (
+   insert into users_to_segments (user_id, segment_id, source)
+   values ($1, $2, $3)
+   on conflict do nothing -- Already there? Nothing happens, as documented.
    returning user_id, segment_id
 )
-insert into operation_history (user_id, segment_id, operation)
-select user_id, segment_id, 'add'
+insert into operation_history (user_id, segment_id, operation, source)
+select user_id, segment_id, 'add', $3
 from insertions;
 `
 		qRemoveFromSegment = `
@@ -181,8 +216,8 @@ with deletions as (
    where user_id = $1 and segment_id = $2
    returning user_id, segment_id
 )
-insert into operation_history (user_id, segment_id, operation)
-select user_id, segment_id, 'remove'
+insert into operation_history (user_id, segment_id, operation, source)
+select user_id, segment_id, 'remove', 'explicit'
 from deletions;
 `
 		qInfect = `
@@ -192,50 +227,63 @@ with random_val as (
    select id
    from segments
    cross join random_val
-   where deleted = false and (xi <= automatic_percent or automatic_percent = 100)
+   where deleted = false and case
+      when salt is null then xi <= automatic_percent or automatic_percent = 100
+      else segment_bucket(salt, $1) < automatic_percent * 100
+   end
 ), insertions as (
-   insert into users_to_segments (user_id, segment_id)
-   select $1, id
+   insert into users_to_segments (user_id, segment_id, source)
+   select $1, id, 'automatic'
    from bonus_segments
    on conflict do nothing 
    returning segment_id
 )
-insert into operation_history (user_id, segment_id, operation)
-select $1, segment_id, 'add'
+insert into operation_history (user_id, segment_id, operation, source)
+select $1, segment_id, 'add', 'automatic'
 from insertions;
 `
 	)
 
 	var (
 		addToSegmendIds []int
-		segmentId       int
-		deleted         bool
+		expiring        = expiring(plans)
 	)
 	for _, name := range addTo {
-		// Get id for name
-		row := tx.QueryRowContext(ctx, qSegmentIdByName, name)
-		switch err = row.Scan(&segmentId, &deleted); {
-		case errors.Is(err, sql.ErrNoRows):
-			log.Printf("Didn't find id for segment %s\n", name)
-			return errNameFree
-		case err != nil:
+		segmentId, err := activeSegmentId(ctx, tx, "add_to_segments", name)
+		if err != nil {
 			return err
-		case deleted:
-			return errSegmentDeleted
 		}
 		addToSegmendIds = append(addToSegmendIds, segmentId)
 
 		// Save relation
-		if _, err = tx.ExecContext(ctx, qAddToSegment, userId, segmentId); err != nil {
+		source := SourceExplicit
+		if ttl > 0 || expiring[name] {
+			source = SourceTTL
+		}
+		if _, err = tx.ExecContext(ctx, qAddToSegment, userId, segmentId, source); err != nil {
 			return err
 		}
 	}
 
+	var planned []plannedTask
 	if ttl > 0 {
-		err = planRemoval(ctx, tx, ttl, userId, addToSegmendIds...)
+		planned, err = planRemoval(ctx, tx, ttl, userId, addToSegmendIds...)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, plan := range plans {
+		segmentId, err := activeSegmentId(ctx, tx, plan.field(), plan.Segment)
 		if err != nil {
 			return err
 		}
+
+		task, err := planAt(ctx, tx, userId, segmentId, plan)
+		if err != nil {
+			return err
+		}
+		planned = append(planned, task)
 	}
 
 	if _, err = tx.ExecContext(ctx, qInfect, userId); err != nil {
@@ -243,16 +291,9 @@ from insertions;
 	}
 
 	for _, name := range removeFrom {
-		// Get id for name
-		row := tx.QueryRowContext(ctx, qSegmentIdByName, name)
-		switch err = row.Scan(&segmentId, &deleted); {
-		case errors.Is(err, sql.ErrNoRows):
-			log.Printf("Didn't find id for segment %s\n", name)
-			return errNameFree
-		case err != nil:
+		segmentId, err := activeSegmentId(ctx, tx, "remove_from_segments", name)
+		if err != nil {
 			return err
-		case deleted:
-			return errSegmentDeleted
 		}
 
 		// Save relation
@@ -261,11 +302,17 @@ from insertions;
 		}
 	}
 
-	return tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	// Only committed plans go to the schedule, otherwise a short TTL could
+	// run out before the plan is visible.
+	s.schedule.plan(planned...)
+	return nil
 }
 
-func GetSegments(ctx context.Context, userId int) ([]string, error) {
-	tx, err := db.BeginTx(ctx, optsRO)
+func (s *Store) GetSegments(ctx context.Context, userId int) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, optsRO)
 	if err != nil {
 		return nil, err
 	}
@@ -296,65 +343,3 @@ where uts.user_id = $1;
 
 	return segments, tx.Commit()
 }
-
-func GetHistory(ctx context.Context, year, month int) (string, error) {
-	tx, err := db.BeginTx(ctx, optsRO)
-	if err != nil {
-		return "", err
-	}
-	defer tx.Rollback()
-
-	// The first moment of the given month and the first moment
-	// of the month after the given one.
-	thisMonth := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
-	var nextMonth time.Time
-	if month == 12 {
-		nextMonth = time.Date(year+1, time.January, 1, 0, 0, 0, 0, time.UTC)
-	} else {
-		nextMonth = time.Date(year, time.Month(month+1), 1, 0, 0, 0, 0, time.UTC)
-	}
-
-	const qHistory = `
-select stamp, user_id, segments.name, operation
-from operation_history
-join segments on segment_id = id
-where stamp >= $1 and stamp < $2;
-`
-	rows, err := tx.QueryContext(ctx, qHistory, thisMonth, nextMonth)
-	if err != nil {
-		return "", err
-	}
-
-	var (
-		buf    strings.Builder
-		csvDoc = csv.NewWriter(&buf)
-	)
-	csvDoc.Comma = ';'
-
-	for rows.Next() {
-		var (
-			stamp       time.Time
-			userId      int
-			segmentName string
-			operation   string
-		)
-
-		err = rows.Scan(&stamp, &userId, &segmentName, &operation)
-		if err != nil {
-			return "", err
-		}
-
-		// See swagger.yml to learn about field order.
-		err = csvDoc.Write([]string{
-			strconv.Itoa(userId),
-			segmentName,
-			operation,
-			stamp.String(),
-		})
-		if err != nil {
-			return "", err
-		}
-	}
-	csvDoc.Flush()
-	return buf.String(), nil
-}
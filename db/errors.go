@@ -0,0 +1,120 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// Error codes. Clients match on them, so never change them.
+const (
+	CodeNameEmpty      = "name_empty"
+	CodeNameTaken      = "name_taken"
+	CodeNameFree       = "name_free"
+	CodeSegmentDeleted = "segment_deleted"
+	CodeBadPercent     = "bad_percent"
+	CodeBadTag         = "bad_tag"
+	CodeBadAttributes  = "bad_attributes"
+	CodeBadRow         = "bad_row"
+	CodeNotPlanned     = "not_planned"
+	CodeInternal       = "internal"
+)
+
+// Error is an error stores return. Compare with errors.Is against the Err*
+// values below, details do not matter then.
+type Error struct {
+	// Machine-readable code, one of the Code* constants.
+	Code string
+
+	// Human-readable message. The same for all errors with the same code.
+	Message string
+
+	// Request field at fault, like `add_to_segments`. Might be empty.
+	Field string
+
+	// Name of the segment at fault. Might be empty.
+	Segment string
+
+	// Whether the same request might succeed later.
+	Retryable bool
+
+	// The original error of an internal error. Never show it to clients.
+	Internal error
+}
+
+func (e *Error) Error() string {
+	if e.Internal != nil {
+		return e.Message + ": " + e.Internal.Error()
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Internal
+}
+
+// Is reports whether target is an *Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// blame returns a copy of the error pointing at the segment from the given
+// request field.
+func (e *Error) blame(field, segment string) *Error {
+	blamed := *e
+	blamed.Field = field
+	blamed.Segment = segment
+	return &blamed
+}
+
+// Errors returned by stores, usually with details. Everything else is an
+// internal error, see AsError.
+var (
+	ErrNameEmpty      = &Error{Code: CodeNameEmpty, Message: "name empty"}
+	ErrNameTaken      = &Error{Code: CodeNameTaken, Message: "name taken"}
+	ErrNameFree       = &Error{Code: CodeNameFree, Message: "name free"}
+	ErrSegmentDeleted = &Error{Code: CodeSegmentDeleted, Message: "segment deleted"}
+	ErrBadPercent     = &Error{Code: CodeBadPercent, Message: "bad percent"}
+	ErrBadTag         = &Error{Code: CodeBadTag, Message: "bad tag"}
+	ErrBadAttributes  = &Error{Code: CodeBadAttributes, Message: "bad attributes"}
+	ErrNotPlanned     = &Error{Code: CodeNotPlanned, Message: "not planned"}
+
+	// For malformed bulk rows, blaming the column at fault.
+	ErrBadRow = &Error{Code: CodeBadRow, Message: "bad row"}
+)
+
+// AsError returns err as an *Error. Errors that are not *Error become
+// internal errors wrapping them.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return &Error{
+		Code:      CodeInternal,
+		Message:   "internal error",
+		Retryable: retryable(err),
+		Internal:  err,
+	}
+}
+
+// retryable tells if err is likely to go away by itself.
+func retryable(err error) bool {
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.As(err, &pqErr):
+		switch pqErr.Code.Class() {
+		case "08", // Connection exception
+			"40", // Transaction rollback, like serialization failure or deadlock
+			"53", // Insufficient resources
+			"57": // Operator intervention, like statement timeout or shutdown
+			return true
+		}
+	}
+	return false
+}
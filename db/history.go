@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// HistoryFilter selects operations for GetHistory. Zero fields select
+// everything.
+type HistoryFilter struct {
+	// Operations at or after From and before To.
+	From, To time.Time
+
+	UserId *int
+
+	// Segment name. The segment may be deleted.
+	Segment string
+
+	// OpAdd or OpRemove.
+	Operation string
+}
+
+// HistoryRecord is an operation from the history.
+type HistoryRecord struct {
+	Stamp time.Time
+
+	UserId int
+
+	Segment string
+
+	// OpAdd or OpRemove.
+	Operation string
+
+	// How the operation came about, see Membership. Empty for operations
+	// recorded before sources were.
+	Source string
+}
+
+func (f HistoryFilter) match(op memOperation, segmentName string) bool {
+	return (f.From.IsZero() || !op.stamp.Before(f.From)) &&
+		(f.To.IsZero() || op.stamp.Before(f.To)) &&
+		(f.UserId == nil || op.userId == *f.UserId) &&
+		(f.Segment == "" || segmentName == f.Segment) &&
+		(f.Operation == "" || op.operation == f.Operation)
+}
+
+func (s *Store) GetHistory(ctx context.Context, filter HistoryFilter, fn func(record HistoryRecord) error) error {
+	tx, err := s.db.BeginTx(ctx, optsRO)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if filter.Segment != "" {
+		const qExists = `select exists (select from segments where name = $1);`
+		var exists bool
+		if err = tx.QueryRowContext(ctx, qExists, filter.Segment).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNameFree.blame("segment", filter.Segment)
+		}
+	}
+
+	// Nulls do not filter.
+	const qHistory = `
+select stamp, user_id, segments.name, operation, coalesce(operation_history.source::text, '')
+from operation_history
+join segments on segment_id = segments.id
+where ($1::timestamptz is null or stamp >= $1)
+  and ($2::timestamptz is null or stamp < $2)
+  and ($3::integer is null or user_id = $3)
+  and ($4::text is null or segments.name = $4)
+  and ($5::operation_type is null or operation = $5)
+order by stamp, operation_history.id;
+`
+	var (
+		from      = sql.NullTime{Time: filter.From, Valid: !filter.From.IsZero()}
+		to        = sql.NullTime{Time: filter.To, Valid: !filter.To.IsZero()}
+		userId    = sql.NullInt64{Valid: filter.UserId != nil}
+		segment   = sql.NullString{String: filter.Segment, Valid: filter.Segment != ""}
+		operation = sql.NullString{String: filter.Operation, Valid: filter.Operation != ""}
+	)
+	if filter.UserId != nil {
+		userId.Int64 = int64(*filter.UserId)
+	}
+	// Rows come as the client reads them. If it goes away, the context is
+	// cancelled and so is the query.
+	rows, err := tx.QueryContext(ctx, qHistory, from, to, userId, segment, operation)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record HistoryRecord
+		err = rows.Scan(&record.Stamp, &record.UserId, &record.Segment, &record.Operation, &record.Source)
+		if err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *MemoryStore) GetHistory(ctx context.Context, filter HistoryFilter, fn func(record HistoryRecord) error) error {
+	m.mu.Lock()
+	if _, ok := m.byName[filter.Segment]; filter.Segment != "" && !ok {
+		m.mu.Unlock()
+		return ErrNameFree.blame("segment", filter.Segment)
+	}
+	var records []HistoryRecord
+	for _, op := range m.history {
+		name := m.segments[op.segmentId-1].name
+		if filter.match(op, name) {
+			records = append(records, HistoryRecord{op.stamp, op.userId, name, op.operation, op.source})
+		}
+	}
+	// fn might be slow, like writing to a client, so do not hold the lock.
+	m.mu.Unlock()
+
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Sources tell how a user got into a segment. In the history, they tell how
+// the operation happened.
+const (
+	// Requested with UpdateUser without TTL.
+	SourceExplicit = "explicit"
+
+	// Chosen by the automatic percent.
+	SourceAutomatic = "automatic"
+
+	// Requested with UpdateUser with TTL. The user is removed when it runs out.
+	SourceTTL = "ttl"
+)
+
+// Membership describes a user in a segment.
+type Membership struct {
+	Segment string
+	Source  string
+
+	// Zero if the user joined before it was recorded.
+	JoinedAt time.Time
+
+	// When the TTL runs out and the user is removed. Zero if never.
+	ExpiresAt time.Time
+}
+
+func (s *Store) GetMemberships(ctx context.Context, userId int) ([]Membership, error) {
+	tx, err := s.db.BeginTx(ctx, optsRO)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const qMemberships = `
+select s.name, uts.source, uts.joined_at,
+   (select min(so.stamp)
+    from scheduled_operations so
+    where so.user_id = uts.user_id and so.segment_id = uts.segment_id and so.operation = 'remove')
+from users_to_segments uts
+join segments s on s.id = uts.segment_id
+where uts.user_id = $1
+order by s.id;
+`
+	rows, err := tx.QueryContext(ctx, qMemberships, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memberships []Membership
+	for rows.Next() {
+		var (
+			membership          Membership
+			joinedAt, expiresAt sql.NullTime
+		)
+		err = rows.Scan(&membership.Segment, &membership.Source, &joinedAt, &expiresAt)
+		if err != nil {
+			return nil, err
+		}
+		membership.JoinedAt, membership.ExpiresAt = joinedAt.Time, expiresAt.Time
+		memberships = append(memberships, membership)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return memberships, tx.Commit()
+}
+
+func (m *MemoryStore) GetMemberships(_ context.Context, userId int) ([]Membership, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for segmentId := range m.members[userId] {
+		ids = append(ids, segmentId)
+	}
+	sort.Ints(ids)
+
+	var memberships []Membership
+	for _, id := range ids {
+		member := m.members[userId][id]
+		memberships = append(memberships, Membership{
+			Segment:   m.segments[id-1].name,
+			Source:    member.source,
+			JoinedAt:  member.joinedAt,
+			ExpiresAt: m.plans[planKey{membership{userId, id}, OpRemove}].stamp,
+		})
+	}
+	return memberships, nil
+}
+
+func (s *Store) GetSegmentsBatch(ctx context.Context, userIds []int) (map[int][]string, error) {
+	ids := make(pq.Int64Array, len(userIds))
+	for i, userId := range userIds {
+		ids[i] = int64(userId)
+	}
+
+	const qBatch = `
+select uts.user_id, s.name
+from users_to_segments uts
+join segments s on s.id = uts.segment_id
+where uts.user_id = any($1)
+order by uts.user_id, s.id;
+`
+	rows, err := s.db.QueryContext(ctx, qBatch, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := make(map[int][]string, len(userIds))
+	for _, userId := range userIds {
+		segments[userId] = []string{}
+	}
+	for rows.Next() {
+		var (
+			userId int
+			name   string
+		)
+		if err = rows.Scan(&userId, &name); err != nil {
+			return nil, err
+		}
+		segments[userId] = append(segments[userId], name)
+	}
+	return segments, rows.Err()
+}
+
+func (m *MemoryStore) GetSegmentsBatch(_ context.Context, userIds []int) (map[int][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segments := make(map[int][]string, len(userIds))
+	for _, userId := range userIds {
+		var ids []int
+		for segmentId := range m.members[userId] {
+			ids = append(ids, segmentId)
+		}
+		sort.Ints(ids)
+
+		names := []string{}
+		for _, id := range ids {
+			names = append(names, m.segments[id-1].name)
+		}
+		segments[userId] = names
+	}
+	return segments, nil
+}
@@ -0,0 +1,558 @@
+package db
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in memory and forgets it when the process
+// exits. It is meant for tests and local development. Behaviour matches Store.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	segments []memSegment // Index is id - 1, like a serial column.
+	byName   map[string]int
+
+	// users_to_segments. Keys are user ids, then segment ids.
+	members map[int]map[int]memMember
+
+	// scheduled_operations.
+	plans    map[planKey]memPlan
+	schedule *scheduler
+
+	history []memOperation
+
+	// segment_changes.
+	changes []memChange
+}
+
+type memSegment struct {
+	id      int
+	name    string
+	deleted bool
+	percent uint
+	salt    string
+
+	createdAt time.Time
+	deletedAt time.Time
+
+	meta SegmentMeta
+}
+
+type memMember struct {
+	source   string
+	joinedAt time.Time
+}
+
+type membership struct {
+	userId    int
+	segmentId int
+}
+
+type planKey struct {
+	membership
+	operation string
+}
+
+type memPlan struct {
+	stamp  time.Time
+	source string
+}
+
+type memChange struct {
+	segmentId int
+	SegmentChange
+}
+
+type memOperation struct {
+	stamp     time.Time
+	userId    int
+	segmentId int
+	operation string
+	source    string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return newMemoryStore(realClock{})
+}
+
+func newMemoryStore(clock clock) *MemoryStore {
+	m := &MemoryStore{
+		byName:  map[string]int{},
+		members: map[int]map[int]memMember{},
+		plans:   map[planKey]memPlan{},
+	}
+	m.schedule = newScheduler(m, clock, scheduleCapacity)
+	// Nothing is planned yet, so it cannot fail.
+	_ = m.schedule.start(context.Background())
+	return m
+}
+
+// Close stops the schedule. Pending plans never happen.
+func (m *MemoryStore) Close() error {
+	m.schedule.close()
+	return nil
+}
+
+// segment returns the segment with the given name, or errors like Store does,
+// blaming the given request field. Call with the mutex locked.
+func (m *MemoryStore) segment(field, name string) (*memSegment, error) {
+	id, ok := m.byName[name]
+	switch {
+	case !ok:
+		return nil, ErrNameFree.blame(field, name)
+	case m.segments[id-1].deleted:
+		return nil, ErrSegmentDeleted.blame(field, name)
+	}
+	return &m.segments[id-1], nil
+}
+
+// add adds the user to the segment and records it in the history. If the user
+// is in the segment already, only the source may change, like in qAddToSegment.
+// Call with the mutex locked.
+func (m *MemoryStore) add(userId, segmentId int, source string) {
+	segments, ok := m.members[userId]
+	if !ok {
+		segments = map[int]memMember{}
+		m.members[userId] = segments
+	}
+	if member, ok := segments[segmentId]; ok {
+		if member.source == SourceAutomatic || source == SourceTTL {
+			member.source = source
+		}
+		segments[segmentId] = member
+		return
+	}
+	now := m.schedule.clock.Now()
+	segments[segmentId] = memMember{source: source, joinedAt: now}
+	m.history = append(m.history, memOperation{now, userId, segmentId, "add", source})
+}
+
+// remove is the opposite of add. The source tells why the user is removed.
+// Call with the mutex locked.
+func (m *MemoryStore) remove(userId, segmentId int, source string) {
+	if _, ok := m.members[userId][segmentId]; !ok {
+		return
+	}
+	delete(m.members[userId], segmentId)
+	m.history = append(m.history, memOperation{m.schedule.clock.Now(), userId, segmentId, "remove", source})
+}
+
+func (m *MemoryStore) CreateSegment(_ context.Context, name string, percent uint, salt string, meta SegmentMeta) error {
+	if name == "" {
+		return ErrNameEmpty.blame("name", "")
+	}
+	meta, err := meta.normalize(name)
+	if err != nil {
+		return err
+	}
+	if percent > 100 {
+		return ErrBadPercent.blame("percent", name)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.byName[name]; ok {
+		return ErrNameTaken.blame("name", name)
+	}
+	id := len(m.segments) + 1
+	m.segments = append(m.segments, memSegment{
+		id:        id,
+		name:      name,
+		percent:   percent,
+		salt:      salt,
+		createdAt: m.schedule.clock.Now(),
+		meta:      meta,
+	})
+	m.byName[name] = id
+
+	m.ramp(&m.segments[id-1], 0, percent)
+	return nil
+}
+
+// shuffle orders users randomly and returns their percent ranks, like
+// percent_rank() over (order by random()).
+func shuffle(users []int) []float64 {
+	sort.Ints(users)
+	rand.Shuffle(len(users), func(i, j int) { users[i], users[j] = users[j], users[i] })
+	ranks := make([]float64, len(users))
+	for i := range users {
+		if len(users) > 1 {
+			ranks[i] = float64(i) / float64(len(users)-1)
+		}
+	}
+	return ranks
+}
+
+// known returns users that are in some segments, but not in this one. Call
+// with the mutex locked.
+func (m *MemoryStore) known(segmentId int) []int {
+	var known []int
+	for userId, segments := range m.members {
+		if _, ok := segments[segmentId]; !ok && len(segments) > 0 {
+			known = append(known, userId)
+		}
+	}
+	return known
+}
+
+// automatic returns users that got into the segment automatically. Call with
+// the mutex locked.
+func (m *MemoryStore) automatic(segmentId int) []int {
+	var automatic []int
+	for userId, segments := range m.members {
+		if member, ok := segments[segmentId]; ok && member.source == SourceAutomatic {
+			automatic = append(automatic, userId)
+		}
+	}
+	return automatic
+}
+
+// ramp is ramp of Store. Call with the mutex locked.
+func (m *MemoryStore) ramp(segment *memSegment, from, to uint) {
+	switch {
+	case to > from && segment.salt != "":
+		for _, userId := range m.known(segment.id) {
+			if inBucket(segment.salt, to, userId) {
+				m.add(userId, segment.id, SourceAutomatic)
+			}
+		}
+	case to < from && segment.salt != "":
+		for _, userId := range m.automatic(segment.id) {
+			if !inBucket(segment.salt, to, userId) {
+				m.remove(userId, segment.id, SourceAutomatic)
+			}
+		}
+	case to > from:
+		fraction := float64(to-from) / float64(100-from)
+		known := m.known(segment.id)
+		for i, rank := range shuffle(known) {
+			if rank < fraction || fraction >= 1 {
+				m.add(known[i], segment.id, SourceAutomatic)
+			}
+		}
+	case to < from:
+		keep := float64(to) / float64(from)
+		automatic := m.automatic(segment.id)
+		for i, rank := range shuffle(automatic) {
+			if rank >= keep {
+				m.remove(automatic[i], segment.id, SourceAutomatic)
+			}
+		}
+	}
+}
+
+func (m *MemoryStore) DeleteSegment(_ context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, err := m.segment("name", name)
+	if err != nil {
+		return err
+	}
+	segment.deleted = true
+	segment.deletedAt = m.schedule.clock.Now()
+	// Like Store, deletion is not recorded in the history.
+	for _, segments := range m.members {
+		delete(segments, segment.id)
+	}
+	for key := range m.plans {
+		if key.segmentId == segment.id {
+			delete(m.plans, key)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) UpdateUser(_ context.Context, userId int, addTo []string, removeFrom []string, ttl int, plans ...Plan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Store does everything in a transaction, so check everything before
+	// changing anything.
+	var addToIds, removeFromIds []int
+	for _, name := range addTo {
+		segment, err := m.segment("add_to_segments", name)
+		if err != nil {
+			return err
+		}
+		addToIds = append(addToIds, segment.id)
+	}
+	for _, name := range removeFrom {
+		segment, err := m.segment("remove_from_segments", name)
+		if err != nil {
+			return err
+		}
+		removeFromIds = append(removeFromIds, segment.id)
+	}
+	planIds := make([]int, len(plans))
+	for i, plan := range plans {
+		segment, err := m.segment(plan.field(), plan.Segment)
+		if err != nil {
+			return err
+		}
+		planIds[i] = segment.id
+	}
+
+	expiring := expiring(plans)
+	for i, segmentId := range addToIds {
+		source := SourceExplicit
+		if ttl > 0 || expiring[addTo[i]] {
+			source = SourceTTL
+		}
+		m.add(userId, segmentId, source)
+	}
+
+	if ttl > 0 {
+		eta := m.schedule.clock.Now().Add(time.Duration(ttl) * time.Second)
+		for _, segmentId := range addToIds {
+			m.planRemoval(eta, userId, segmentId)
+		}
+	}
+	for i, plan := range plans {
+		key := planKey{membership{userId, planIds[i]}, plan.Operation}
+		m.plans[key] = memPlan{stamp: plan.At, source: plan.source()}
+		m.schedule.plan(plannedTask{stamp: plan.At, userId: userId, segmentId: planIds[i], operation: plan.Operation})
+	}
+
+	m.infect(userId)
+
+	for _, segmentId := range removeFromIds {
+		m.remove(userId, segmentId, SourceExplicit)
+	}
+	return nil
+}
+
+// infect adds the user to automatic segments like qInfect: one random value
+// for all of them, unless they have a salt. Call with the mutex locked.
+func (m *MemoryStore) infect(userId int) {
+	xi := rand.Float64() * 100.0
+	for _, segment := range m.segments {
+		switch {
+		case segment.deleted:
+		case segment.salt != "" && inBucket(segment.salt, segment.percent, userId),
+			segment.salt == "" && (xi <= float64(segment.percent) || segment.percent == 100):
+			m.add(userId, segment.id, SourceAutomatic)
+		}
+	}
+}
+
+// planRemoval removes the user from the segment at eta instead of any planned
+// removal, like planRemoval. Call with the mutex locked.
+func (m *MemoryStore) planRemoval(eta time.Time, userId, segmentId int) {
+	key := planKey{membership{userId, segmentId}, OpRemove}
+	m.plans[key] = memPlan{stamp: eta, source: SourceTTL}
+	m.schedule.plan(plannedTask{stamp: eta, userId: userId, segmentId: segmentId, operation: OpRemove})
+}
+
+func (m *MemoryStore) upcomingPlans(_ context.Context, limit int) ([]plannedTask, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var tasks []plannedTask
+	for key, plan := range m.plans {
+		tasks = append(tasks, plannedTask{
+			stamp:     plan.stamp,
+			userId:    key.userId,
+			segmentId: key.segmentId,
+			operation: key.operation,
+		})
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		return tasks[i].stamp.Before(tasks[j].stamp)
+	})
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	return tasks, nil
+}
+
+func (m *MemoryStore) carryOutPlans(_ context.Context, now time.Time, limit int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var due []planKey
+	for key, plan := range m.plans {
+		if !plan.stamp.After(now) {
+			due = append(due, key)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return m.plans[due[i]].stamp.Before(m.plans[due[j]].stamp)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	for _, key := range due {
+		plan := m.plans[key]
+		delete(m.plans, key)
+		if key.operation == OpAdd {
+			m.add(key.userId, key.segmentId, plan.source)
+		} else {
+			m.remove(key.userId, key.segmentId, plan.source)
+		}
+	}
+	return len(due), nil
+}
+
+func (m *MemoryStore) GetSegments(_ context.Context, userId int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for segmentId := range m.members[userId] {
+		ids = append(ids, segmentId)
+	}
+	sort.Ints(ids)
+
+	var segments []string
+	for _, id := range ids {
+		segments = append(segments, m.segments[id-1].name)
+	}
+	return segments, nil
+}
+
+func (m *MemoryStore) ListSegments(_ context.Context, filter SegmentFilter) ([]SegmentInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var segments []SegmentInfo
+	for _, segment := range m.segments {
+		if filter.Limit > 0 && len(segments) == filter.Limit {
+			break
+		}
+		if segment.id > filter.After &&
+			(filter.Deleted == nil || *filter.Deleted == segment.deleted) &&
+			strings.HasPrefix(segment.name, filter.Prefix) &&
+			(filter.Tag == "" || hasTag(segment.meta.Tags, filter.Tag)) {
+			segments = append(segments, m.info(segment))
+		}
+	}
+	return segments, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemoryStore) UpdateSegment(_ context.Context, name string, update SegmentUpdate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, err := m.segment("name", name)
+	if err != nil {
+		return err
+	}
+	percent, meta, changes, err := update.apply(name, segment.percent, segment.meta)
+	if err != nil {
+		return err
+	}
+	m.ramp(segment, segment.percent, percent)
+	segment.percent, segment.meta = percent, meta
+	now := m.schedule.clock.Now()
+	for _, change := range changes {
+		change.Stamp = now
+		m.changes = append(m.changes, memChange{segment.id, change})
+	}
+	return nil
+}
+
+func (m *MemoryStore) SegmentChanges(_ context.Context, name string) ([]SegmentChange, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok := m.byName[name]
+	if !ok {
+		return nil, ErrNameFree.blame("name", name)
+	}
+	changes := []SegmentChange{}
+	for _, change := range m.changes {
+		if change.segmentId == id {
+			changes = append(changes, change.SegmentChange)
+		}
+	}
+	return changes, nil
+}
+
+func (m *MemoryStore) InspectSegment(_ context.Context, name string) (SegmentInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok := m.byName[name]
+	if !ok {
+		return SegmentInfo{}, ErrNameFree.blame("name", name)
+	}
+	return m.info(m.segments[id-1]), nil
+}
+
+func (m *MemoryStore) ListMembers(_ context.Context, name string, filter MemberFilter, fn func(userId int) error) error {
+	m.mu.Lock()
+	// Deleted segments have no members, so they are fine.
+	id, ok := m.byName[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrNameFree.blame("name", name)
+	}
+	var users []int
+	if filter.AsOf != nil {
+		for key := range m.replay(*filter.AsOf) {
+			if key.segmentId == id && (filter.After == nil || key.userId > *filter.After) {
+				users = append(users, key.userId)
+			}
+		}
+	} else {
+		for userId, segments := range m.members {
+			if _, ok := segments[id]; ok && (filter.After == nil || userId > *filter.After) {
+				users = append(users, userId)
+			}
+		}
+	}
+	// fn might be slow, like writing to a client, so do not hold the lock.
+	m.mu.Unlock()
+
+	sort.Ints(users)
+	if filter.Limit > 0 && len(users) > filter.Limit {
+		users = users[:filter.Limit]
+	}
+	for _, userId := range users {
+		if err := fn(userId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// info describes the segment like qSegmentInfo. Call with the mutex locked.
+func (m *MemoryStore) info(segment memSegment) SegmentInfo {
+	info := SegmentInfo{
+		Id:               segment.id,
+		Name:             segment.name,
+		AutomaticPercent: segment.percent,
+		Deleted:          segment.deleted,
+		Salt:             segment.salt,
+		CreatedAt:        segment.createdAt,
+		DeletedAt:        segment.deletedAt,
+		SegmentMeta:      segment.meta,
+	}
+	for userId, segments := range m.members {
+		if _, ok := segments[segment.id]; !ok {
+			continue
+		}
+		info.Members++
+		if _, ok := m.plans[planKey{membership{userId, segment.id}, OpRemove}]; ok {
+			info.PendingRemovals++
+		}
+	}
+	return info
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+)
+
+// SegmentMeta tells people what a segment is for. The service itself does not
+// care about it.
+type SegmentMeta struct {
+	Description string
+
+	// Team that owns the segment.
+	Owner string
+
+	// Free-form labels. Listings filter by them.
+	Tags []string
+
+	// Custom JSON object. Nil means empty.
+	Attributes json.RawMessage
+}
+
+// SegmentUpdate changes a segment. Nil fields stay as they are.
+type SegmentUpdate struct {
+	// A new automatic percent. When it goes up, known users not in the
+	// segment are enrolled to make up the difference. When it goes down,
+	// automatically enrolled users are removed, requested ones stay.
+	Percent *uint
+
+	Description *string
+	Owner       *string
+	Tags        *[]string
+	Attributes  json.RawMessage
+}
+
+// SegmentChange is a change of one field of a segment. Values are JSON.
+type SegmentChange struct {
+	Stamp time.Time
+	Field string
+	Old   json.RawMessage
+	New   json.RawMessage
+}
+
+// normalize checks the metadata and brings it to the form stores keep: tags
+// without duplicates and attributes as compact JSON with sorted keys.
+func (meta SegmentMeta) normalize(segment string) (SegmentMeta, error) {
+	var (
+		tags = []string{}
+		seen = map[string]bool{}
+	)
+	for _, tag := range meta.Tags {
+		if tag == "" {
+			return meta, ErrBadTag.blame("tags", segment)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	meta.Tags = tags
+
+	// Null is as good as no attributes.
+	if len(meta.Attributes) == 0 || string(meta.Attributes) == "null" {
+		meta.Attributes = json.RawMessage("{}")
+	}
+	attributes, err := canonicalJSON(meta.Attributes)
+	if err != nil || attributes[0] != '{' {
+		return meta, ErrBadAttributes.blame("attributes", segment)
+	}
+	meta.Attributes = attributes
+	return meta, nil
+}
+
+// apply returns the percent and the metadata with the update applied and what
+// has changed. Stamps of the changes are not set.
+func (u SegmentUpdate) apply(segment string, percent uint, meta SegmentMeta) (uint, SegmentMeta, []SegmentChange, error) {
+	updatedPercent := percent
+	if u.Percent != nil {
+		updatedPercent = *u.Percent
+	}
+	if updatedPercent > 100 {
+		return percent, meta, nil, ErrBadPercent.blame("percent", segment)
+	}
+
+	// Stored metadata is fine, but might be in another form, like nil tags.
+	meta, err := meta.normalize(segment)
+	if err != nil {
+		return percent, meta, nil, err
+	}
+
+	updated := meta
+	if u.Description != nil {
+		updated.Description = *u.Description
+	}
+	if u.Owner != nil {
+		updated.Owner = *u.Owner
+	}
+	if u.Tags != nil {
+		updated.Tags = *u.Tags
+	}
+	if u.Attributes != nil {
+		updated.Attributes = u.Attributes
+	}
+	updated, err = updated.normalize(segment)
+	if err != nil {
+		return percent, meta, nil, err
+	}
+
+	var changes []SegmentChange
+	for _, field := range []struct {
+		name     string
+		old, new any
+	}{
+		{"automatic_percent", percent, updatedPercent},
+		{"description", meta.Description, updated.Description},
+		{"owner", meta.Owner, updated.Owner},
+		{"tags", meta.Tags, updated.Tags},
+		{"attributes", meta.Attributes, updated.Attributes},
+	} {
+		if reflect.DeepEqual(field.old, field.new) {
+			continue
+		}
+		change := SegmentChange{Field: field.name}
+		if change.Old, err = marshalJSON(field.old); err != nil {
+			return percent, meta, nil, err
+		}
+		if change.New, err = marshalJSON(field.new); err != nil {
+			return percent, meta, nil, err
+		}
+		changes = append(changes, change)
+	}
+	return updatedPercent, updated, changes, nil
+}
+
+// canonicalJSON returns the JSON value compacted, with sorted keys. Postgres
+// rewrites jsonb in its own way, so values are passed through it on the way
+// in and on the way out.
+func canonicalJSON(raw json.RawMessage) (json.RawMessage, error) {
+	if !json.Valid(raw) {
+		return nil, errors.New("invalid JSON")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber() // Keep big numbers as they are
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return marshalJSON(v)
+}
+
+// marshalJSON is json.Marshal without escaping HTML.
+func marshalJSON(v any) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
@@ -0,0 +1,293 @@
+package db
+
+import (
+	"avito2023/config"
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations are pairs of files migrations/NNNN_name.up.sql and
+// migrations/NNNN_name.down.sql. Never edit applied migrations, add new ones.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Any number shared by all instances. Runners wait for each other on it.
+const migrationLock = 2023_08_31
+
+type migration struct {
+	version  int
+	name     string
+	up, down string
+}
+
+// MigrationStatus tells whether a migration is applied.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time // Zero if not applied.
+}
+
+func loadMigrations() ([]migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		var (
+			filename = entry.Name()
+			isUp     = strings.HasSuffix(filename, ".up.sql")
+			base     = strings.TrimSuffix(filename, ".up.sql")
+		)
+		if !isUp {
+			if !strings.HasSuffix(filename, ".down.sql") {
+				return nil, fmt.Errorf("migration %s: want .up.sql or .down.sql", filename)
+			}
+			base = strings.TrimSuffix(filename, ".down.sql")
+		}
+		prefix, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: want NNNN_name", filename)
+		}
+
+		contents, err := migrationFiles.ReadFile("migrations/" + filename)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if isUp {
+			m.up = string(contents)
+		} else {
+			m.down = string(contents)
+		}
+	}
+
+	var migrations []migration
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %04d_%s: both up and down are required", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
+
+// migrator applies migrations on a dedicated connection which holds the
+// advisory lock.
+type migrator struct {
+	conn       *sql.Conn
+	migrations []migration
+}
+
+// withMigrator connects, takes the lock and calls f. Other runners wait
+// until f returns.
+func withMigrator(ctx context.Context, db *sql.DB, f func(*migrator) error) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.ExecContext(ctx, `select pg_advisory_lock($1);`, migrationLock); err != nil {
+		return err
+	}
+	defer func() {
+		// The lock is also gone when the connection is closed, so we don't
+		// care much about errors here.
+		_, _ = conn.ExecContext(context.Background(), `select pg_advisory_unlock($1);`, migrationLock)
+	}()
+
+	const qTable = `
+create table if not exists schema_migrations
+(
+	version    integer primary key,
+	name       text not null,
+	applied_at timestamp with time zone not null default now()
+);
+`
+	if _, err = conn.ExecContext(ctx, qTable); err != nil {
+		return err
+	}
+	return f(&migrator{conn: conn, migrations: migrations})
+}
+
+func (m *migrator) applied(ctx context.Context) (map[int]time.Time, error) {
+	return appliedMigrations(ctx, m.conn)
+}
+
+// queryer is *sql.DB or *sql.Conn.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// appliedMigrations reads schema_migrations, which must exist.
+func appliedMigrations(ctx context.Context, q queryer) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(ctx, `select version, applied_at from schema_migrations;`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var (
+			version int
+			stamp   time.Time
+		)
+		if err = rows.Scan(&version, &stamp); err != nil {
+			return nil, err
+		}
+		applied[version] = stamp
+	}
+	return applied, rows.Err()
+}
+
+// run runs the migration's script and updates schema_migrations in one
+// transaction.
+func (m *migrator) run(ctx context.Context, mig migration, up bool) error {
+	tx, err := m.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script := mig.down
+	if up {
+		script = mig.up
+	}
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %04d_%s: %w", mig.version, mig.name, err)
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, name) values ($1, $2);`, mig.version, mig.name)
+	} else {
+		_, err = tx.ExecContext(ctx, `delete from schema_migrations where version = $1;`, mig.version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateUp(ctx context.Context, db *sql.DB) error {
+	return withMigrator(ctx, db, func(m *migrator) error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.version]; ok {
+				continue
+			}
+			if err = m.run(ctx, mig, true); err != nil {
+				return err
+			}
+			log.Printf("Applied migration %04d_%s\n", mig.version, mig.name)
+		}
+		return nil
+	})
+}
+
+// MigrateUp applies all pending migrations.
+func MigrateUp(ctx context.Context, cfg config.Database) error {
+	db, err := connect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return migrateUp(ctx, db)
+}
+
+// MigrateDown reverts the given number of the latest applied migrations.
+func MigrateDown(ctx context.Context, cfg config.Database, steps int) error {
+	db, err := connect(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return withMigrator(ctx, db, func(m *migrator) error {
+		applied, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.version]; !ok {
+				continue
+			}
+			if err = m.run(ctx, mig, false); err != nil {
+				return err
+			}
+			log.Printf("Reverted migration %04d_%s\n", mig.version, mig.name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// MigrationStatuses lists all known migrations, oldest first. It only reads,
+// so it neither waits for running migrations nor creates schema_migrations.
+// Without the table, nothing is applied.
+func MigrationStatuses(ctx context.Context, cfg config.Database) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := connect(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var exists bool
+	err = db.QueryRowContext(ctx, `select to_regclass('schema_migrations') is not null;`).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	applied := map[int]time.Time{}
+	if exists {
+		if applied, err = appliedMigrations(ctx, db); err != nil {
+			return nil, err
+		}
+	}
+
+	var statuses []MigrationStatus
+	for _, mig := range migrations {
+		stamp, ok := applied[mig.version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   mig.version,
+			Name:      mig.name,
+			Applied:   ok,
+			AppliedAt: stamp,
+		})
+	}
+	return statuses, nil
+}
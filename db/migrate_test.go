@@ -0,0 +1,63 @@
+package db
+
+import (
+	"avito2023/config"
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, mig := range migrations {
+		if mig.version != i+1 {
+			t.Errorf("migration %04d_%s: want version %d, versions must have no gaps", mig.version, mig.name, i+1)
+		}
+	}
+}
+
+// Status only reads, so a running migration does not hold it up.
+func TestPostgresMigrationStatuses(t *testing.T) {
+	if os.Getenv("TEST_BACKEND") != "postgres" {
+		t.Skip("set TEST_BACKEND=postgres to run")
+	}
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	db, err := connect(ctx, cfg.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err = migrateUp(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, `select pg_advisory_lock($1);`, migrationLock); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.ExecContext(context.Background(), `select pg_advisory_unlock($1);`, migrationLock)
+
+	statuses, err := MigrationStatuses(ctx, cfg.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied {
+			t.Errorf("migration %04d_%s is not applied", status.Version, status.Name)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+drop table operation_history;
+drop type operation_type;
+drop table delayed_removals;
+drop table users_to_segments;
+drop table segments;
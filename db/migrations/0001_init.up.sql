@@ -1,4 +1,6 @@
-create table segments
+-- The schema that was applied by docker-entrypoint-initdb.d before migrations
+-- existed. Hence the guards: such databases adopt this migration as is.
+create table if not exists segments
 (
 	id                serial primary key,
 	name              text unique,
@@ -9,7 +11,7 @@ create table segments
 		check ( automatic_percent >= 0 and automatic_percent <= 100 )
 );
 
-create table users_to_segments
+create table if not exists users_to_segments
 (
 	user_id    integer,
 	segment_id integer
@@ -17,7 +19,7 @@ create table users_to_segments
 	unique (user_id, segment_id)
 );
 
-create table delayed_removals
+create table if not exists delayed_removals
 (
 	stamp      timestamp,
 	user_id    integer,
@@ -25,9 +27,14 @@ create table delayed_removals
 		references segments (id)
 );
 
-create type operation_type as enum ( 'add', 'remove' );
+do $$
+begin
+	create type operation_type as enum ( 'add', 'remove' );
+exception
+	when duplicate_object then null;
+end $$;
 
-create table operation_history
+create table if not exists operation_history
 (
 	stamp      timestamp with time zone default now(),
 	user_id    integer,
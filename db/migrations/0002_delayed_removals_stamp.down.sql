@@ -0,0 +1,4 @@
+drop index delayed_removals_stamp;
+
+alter table delayed_removals
+	alter column stamp type timestamp using stamp at time zone 'UTC';
@@ -0,0 +1,6 @@
+-- Stamps were written as local time of the server, which is UTC in our
+-- containers. The scheduler reads plans in stamp order.
+alter table delayed_removals
+	alter column stamp type timestamp with time zone using stamp at time zone 'UTC';
+
+create index delayed_removals_stamp on delayed_removals (stamp);
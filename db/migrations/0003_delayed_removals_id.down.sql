@@ -0,0 +1,2 @@
+alter table delayed_removals
+	drop column id;
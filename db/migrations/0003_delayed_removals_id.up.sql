@@ -0,0 +1,3 @@
+-- Instances lock due plans by id to share the work.
+alter table delayed_removals
+	add column id bigserial primary key;
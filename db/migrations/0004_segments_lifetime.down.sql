@@ -0,0 +1,5 @@
+drop index delayed_removals_segment_id;
+drop index users_to_segments_segment_id;
+alter table segments
+	drop column deleted_at,
+	drop column created_at;
@@ -0,0 +1,12 @@
+-- Segments created before this migration have no creation time.
+alter table segments
+	add column created_at timestamptz,
+	add column deleted_at timestamptz;
+alter table segments
+	alter column created_at set default now();
+
+-- Segment listings count members and plans per segment.
+create index users_to_segments_segment_id
+	on users_to_segments (segment_id);
+create index delayed_removals_segment_id
+	on delayed_removals (segment_id);
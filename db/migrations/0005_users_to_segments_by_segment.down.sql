@@ -0,0 +1,3 @@
+drop index users_to_segments_segment_id_user_id;
+create index users_to_segments_segment_id
+	on users_to_segments (segment_id);
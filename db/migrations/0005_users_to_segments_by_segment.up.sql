@@ -0,0 +1,4 @@
+-- Members of a segment are listed in user_id order.
+drop index users_to_segments_segment_id;
+create index users_to_segments_segment_id_user_id
+	on users_to_segments (segment_id, user_id);
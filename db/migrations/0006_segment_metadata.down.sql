@@ -0,0 +1,7 @@
+drop table segment_changes;
+drop index segments_tags;
+alter table segments
+	drop column attributes,
+	drop column tags,
+	drop column owner,
+	drop column description;
@@ -0,0 +1,22 @@
+alter table segments
+	add column description text not null default '',
+	add column owner       text not null default '',
+	add column tags        text[] not null default '{}',
+	add column attributes  jsonb not null default '{}';
+
+-- Listings filter segments by tag.
+create index segments_tags on segments using gin (tags);
+
+-- Changes of segments themselves, one row per changed field. Values are JSON.
+create table segment_changes
+(
+	id         bigserial primary key,
+	stamp      timestamptz not null default now(),
+	segment_id integer not null
+		references segments (id),
+	field      text not null,
+	old_value  jsonb not null,
+	new_value  jsonb not null
+);
+
+create index segment_changes_segment_id on segment_changes (segment_id, id);
@@ -0,0 +1,5 @@
+-- Whether the user got into the segment by its automatic percent rather than
+-- by request. Lowering the percent removes only such users. Memberships made
+-- before this migration count as requested, so they are never removed.
+alter table users_to_segments
+	add column automatic boolean not null default false;
@@ -0,0 +1,3 @@
+drop function segment_bucket;
+alter table segments
+	drop column salt;
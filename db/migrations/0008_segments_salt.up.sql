@@ -0,0 +1,14 @@
+-- Segments with a salt choose automatic members by hash instead of random():
+-- a user is in if their bucket is less than automatic_percent * 100.
+alter table segments
+	add column salt text;
+
+-- Bucket of the user in 0..9999: the first 4 bytes of md5 of "salt:user_id"
+-- as a big-endian unsigned number, modulo 10000. Keep it in sync with Bucket
+-- in package db, clients compute it too.
+create function segment_bucket(salt text, user_id integer) returns integer
+	language sql
+	immutable
+as $$
+	select (('x' || substr(md5(salt || ':' || user_id::text), 1, 8))::bit(32)::bigint % 10000)::integer;
+$$;
@@ -0,0 +1,11 @@
+alter table operation_history
+	drop column source;
+
+alter table users_to_segments
+	add column automatic boolean not null default false;
+update users_to_segments
+set automatic = source = 'automatic';
+alter table users_to_segments
+	drop column source;
+
+drop type membership_source;
@@ -0,0 +1,23 @@
+-- How a user got into a segment: by request, by the automatic percent, or by
+-- request with TTL. For history records, how the operation happened.
+create type membership_source as enum ( 'explicit', 'automatic', 'ttl' );
+
+alter table users_to_segments
+	add column source membership_source not null default 'explicit';
+
+update users_to_segments uts
+set source = case
+	when automatic then 'automatic'::membership_source
+	when exists (
+		select from delayed_removals dr
+		where dr.user_id = uts.user_id and dr.segment_id = uts.segment_id
+	) then 'ttl'::membership_source
+	else 'explicit'::membership_source
+end;
+
+alter table users_to_segments
+	drop column automatic;
+
+-- Unknown for operations before this migration.
+alter table operation_history
+	add column source membership_source;
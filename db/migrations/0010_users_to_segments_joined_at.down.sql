@@ -0,0 +1,2 @@
+alter table users_to_segments
+	drop column joined_at;
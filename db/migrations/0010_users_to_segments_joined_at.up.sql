@@ -0,0 +1,14 @@
+-- When the user got into the segment. For memberships made before this
+-- migration, the time of the last addition in the history, if any.
+alter table users_to_segments
+	add column joined_at timestamptz;
+
+update users_to_segments uts
+set joined_at = (
+	select max(oh.stamp)
+	from operation_history oh
+	where oh.user_id = uts.user_id and oh.segment_id = uts.segment_id and oh.operation = 'add'
+);
+
+alter table users_to_segments
+	alter column joined_at set default now();
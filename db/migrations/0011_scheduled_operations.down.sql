@@ -0,0 +1,20 @@
+alter table scheduled_operations
+	drop constraint scheduled_operations_plan;
+
+delete from scheduled_operations
+where operation = 'add';
+
+alter table scheduled_operations
+	drop column operation,
+	drop column source;
+
+alter sequence scheduled_operations_id_seq
+	rename to delayed_removals_id_seq;
+alter index scheduled_operations_segment_id
+	rename to delayed_removals_segment_id;
+alter index scheduled_operations_stamp
+	rename to delayed_removals_stamp;
+alter index scheduled_operations_pkey
+	rename to delayed_removals_pkey;
+alter table scheduled_operations
+	rename to delayed_removals;
@@ -0,0 +1,27 @@
+-- Plans are not only removals now: users can be added to segments later too.
+alter table delayed_removals
+	rename to scheduled_operations;
+alter index delayed_removals_pkey
+	rename to scheduled_operations_pkey;
+alter index delayed_removals_stamp
+	rename to scheduled_operations_stamp;
+alter index delayed_removals_segment_id
+	rename to scheduled_operations_segment_id;
+alter sequence delayed_removals_id_seq
+	rename to scheduled_operations_id_seq;
+
+-- The source is what the operation is recorded with in the history: TTL for
+-- removals after TTL, explicit for operations planned for a given time.
+alter table scheduled_operations
+	add column operation operation_type not null default 'remove',
+	add column source    membership_source not null default 'ttl';
+
+-- One plan per user, segment and operation. Of duplicates, only the earliest
+-- one did anything.
+delete from scheduled_operations so
+using scheduled_operations earlier
+where earlier.user_id = so.user_id and earlier.segment_id = so.segment_id
+  and (earlier.stamp, earlier.id) < (so.stamp, so.id);
+
+alter table scheduled_operations
+	add constraint scheduled_operations_plan unique (user_id, segment_id, operation);
@@ -0,0 +1,4 @@
+drop index operation_history_segment_id_user_id_stamp;
+drop index operation_history_user_id_segment_id_stamp;
+alter table operation_history
+	drop column id;
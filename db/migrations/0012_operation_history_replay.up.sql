@@ -0,0 +1,10 @@
+-- Memberships in the past are replayed from the history: the last operation
+-- on each membership by a moment, per user or per segment. Operations of one
+-- transaction share the stamp, so the id orders them.
+alter table operation_history
+	add column id bigserial;
+
+create index operation_history_user_id_segment_id_stamp
+	on operation_history (user_id, segment_id, stamp, id);
+create index operation_history_segment_id_user_id_stamp
+	on operation_history (segment_id, user_id, stamp, id);
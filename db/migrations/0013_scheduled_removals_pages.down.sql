@@ -0,0 +1 @@
+drop index scheduled_operations_removals;
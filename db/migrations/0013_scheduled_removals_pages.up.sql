@@ -0,0 +1,4 @@
+-- Planned removals from a segment are listed in pages by (stamp, user_id).
+create index scheduled_operations_removals
+	on scheduled_operations (segment_id, stamp, user_id)
+	where operation = 'remove';
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+)
+
+// Operations on memberships.
+const (
+	OpAdd    = "add"
+	OpRemove = "remove"
+)
+
+// Plan is an operation on a membership planned for later.
+type Plan struct {
+	Segment string
+
+	// OpAdd or OpRemove.
+	Operation string
+
+	// When to carry it out. Plans in the past are carried out right away.
+	At time.Time
+
+	// How the operation is recorded in the history: SourceTTL for removals
+	// after TTL, SourceExplicit for the rest. Set it to SourceTTL for a
+	// removal from a segment the user is added to in the same call to give the
+	// segment its own TTL. Stores set the rest.
+	Source string
+}
+
+// source is the source of the plan to save.
+func (p Plan) source() string {
+	if p.Operation == OpRemove && p.Source == SourceTTL {
+		return SourceTTL
+	}
+	return SourceExplicit
+}
+
+// expiring returns segments that plans give their own TTL.
+func expiring(plans []Plan) map[string]bool {
+	segments := map[string]bool{}
+	for _, plan := range plans {
+		if plan.source() == SourceTTL {
+			segments[plan.Segment] = true
+		}
+	}
+	return segments
+}
+
+// field is the request field that plans come from, for errors.
+func (p Plan) field() string {
+	if p.Operation == OpAdd {
+		return "add_at"
+	}
+	return "remove_at"
+}
+
+// planAt saves the plan for the user and the segment instead of any plan for
+// the same operation. Pass the returned task to the schedule after commit.
+func planAt(ctx context.Context, tx *sql.Tx, userId, segmentId int, plan Plan) (plannedTask, error) {
+	const qPlan = `
+insert into scheduled_operations (stamp, user_id, segment_id, operation, source)
+values ($1, $2, $3, $4, $5)
+on conflict (user_id, segment_id, operation) do update
+set stamp = excluded.stamp, source = excluded.source;
+`
+	_, err := tx.ExecContext(ctx, qPlan, plan.At, userId, segmentId, plan.Operation, plan.source())
+	return plannedTask{stamp: plan.At, userId: userId, segmentId: segmentId, operation: plan.Operation}, err
+}
+
+func (s *Store) GetPlans(ctx context.Context, userId int) ([]Plan, error) {
+	const qPlans = `
+select s.name, so.operation, so.stamp, so.source
+from scheduled_operations so
+join segments s on s.id = so.segment_id
+where so.user_id = $1
+order by so.stamp, s.id, so.operation;
+`
+	rows, err := s.db.QueryContext(ctx, qPlans, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []Plan
+	for rows.Next() {
+		var plan Plan
+		if err = rows.Scan(&plan.Segment, &plan.Operation, &plan.At, &plan.Source); err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	return plans, rows.Err()
+}
+
+func (m *MemoryStore) GetPlans(_ context.Context, userId int) ([]Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var keys []planKey
+	for key := range m.plans {
+		if key.userId == userId {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := m.plans[keys[i]].stamp, m.plans[keys[j]].stamp
+		switch {
+		case !a.Equal(b):
+			return a.Before(b)
+		case keys[i].segmentId != keys[j].segmentId:
+			return keys[i].segmentId < keys[j].segmentId
+		}
+		return keys[i].operation < keys[j].operation
+	})
+
+	var plans []Plan
+	for _, key := range keys {
+		plan := m.plans[key]
+		plans = append(plans, Plan{
+			Segment:   m.segments[key.segmentId-1].name,
+			Operation: key.operation,
+			At:        plan.stamp,
+			Source:    plan.source,
+		})
+	}
+	return plans, nil
+}
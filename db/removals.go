@@ -0,0 +1,237 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Removal is a planned removal of a user from a segment.
+type Removal struct {
+	UserId int
+
+	At time.Time
+
+	// SourceTTL for removals after TTL, SourceExplicit for the rest.
+	Source string
+}
+
+func (s *Store) ListRemovals(ctx context.Context, name string, filter RemovalFilter, fn func(removal Removal) error) error {
+	tx, err := s.db.BeginTx(ctx, optsRO)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Deleted segments have no plans, so they are fine.
+	const qId = `select id from segments where name = $1;`
+	var id int
+	switch err = tx.QueryRowContext(ctx, qId, name).Scan(&id); {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNameFree.blame("name", name)
+	case err != nil:
+		return err
+	}
+
+	// Nulls do not filter. Pages follow scheduled_operations_removals.
+	const qRemovals = `
+select user_id, stamp, source
+from scheduled_operations
+where segment_id = $1 and operation = 'remove'
+  and ($2::timestamptz is null or (stamp, user_id) > ($2, $3))
+order by stamp, user_id
+limit $4;
+`
+	var (
+		afterAt   sql.NullTime
+		afterUser int
+		limit     = sql.NullInt64{Int64: int64(filter.Limit), Valid: filter.Limit > 0}
+	)
+	if filter.After != nil {
+		afterAt = sql.NullTime{Time: filter.After.At, Valid: true}
+		afterUser = filter.After.UserId
+	}
+	rows, err := tx.QueryContext(ctx, qRemovals, id, afterAt, afterUser, limit)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var removal Removal
+		if err = rows.Scan(&removal.UserId, &removal.At, &removal.Source); err != nil {
+			return err
+		}
+		if err = fn(removal); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) ExtendRemoval(ctx context.Context, userId int, name string, at time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	segmentId, err := activeSegmentId(ctx, tx, "segment", name)
+	if err != nil {
+		return err
+	}
+
+	const qMove = `
+update scheduled_operations
+set stamp = $3
+where user_id = $1 and segment_id = $2 and operation = 'remove';
+`
+	result, err := tx.ExecContext(ctx, qMove, userId, segmentId, at)
+	if err != nil {
+		return err
+	}
+	switch n, err := result.RowsAffected(); {
+	case err != nil:
+		return err
+	case n == 0:
+		return ErrNotPlanned.blame("segment", name)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	s.schedule.plan(plannedTask{stamp: at, userId: userId, segmentId: segmentId, operation: OpRemove})
+	return nil
+}
+
+func (s *Store) CancelRemoval(ctx context.Context, userId int, name string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	segmentId, err := activeSegmentId(ctx, tx, "segment", name)
+	if err != nil {
+		return err
+	}
+
+	// Without the removal, a TTL-managed membership is an explicit one.
+	const qCancel = `
+with cancelled as (
+   delete from scheduled_operations
+   where user_id = $1 and segment_id = $2 and operation = 'remove'
+   returning user_id, segment_id
+), kept as (
+   update users_to_segments uts
+   set source = 'explicit'
+   from cancelled
+   where uts.user_id = cancelled.user_id and uts.segment_id = cancelled.segment_id
+     and uts.source = 'ttl'
+)
+select count(*) from cancelled;
+`
+	var n int
+	if err = tx.QueryRowContext(ctx, qCancel, userId, segmentId).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotPlanned.blame("segment", name)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	s.schedule.forget(plannedTask{userId: userId, segmentId: segmentId, operation: OpRemove})
+	return nil
+}
+
+func (m *MemoryStore) ListRemovals(_ context.Context, name string, filter RemovalFilter, fn func(removal Removal) error) error {
+	m.mu.Lock()
+	// Deleted segments have no plans, so they are fine.
+	id, ok := m.byName[name]
+	if !ok {
+		m.mu.Unlock()
+		return ErrNameFree.blame("name", name)
+	}
+	var removals []Removal
+	for key, plan := range m.plans {
+		if key.segmentId == id && key.operation == OpRemove {
+			removals = append(removals, Removal{UserId: key.userId, At: plan.stamp, Source: plan.source})
+		}
+	}
+	// fn might be slow, like writing to a client, so do not hold the lock.
+	m.mu.Unlock()
+
+	sort.Slice(removals, func(i, j int) bool {
+		return removals[i].before(removals[j])
+	})
+	sent := 0
+	for _, removal := range removals {
+		if filter.After != nil && !filter.After.before(removal) {
+			continue
+		}
+		if filter.Limit > 0 && sent == filter.Limit {
+			break
+		}
+		if err := fn(removal); err != nil {
+			return err
+		}
+		sent++
+	}
+	return nil
+}
+
+// before tells if r goes before other in ListRemovals.
+func (r Removal) before(other Removal) bool {
+	if !r.At.Equal(other.At) {
+		return r.At.Before(other.At)
+	}
+	return r.UserId < other.UserId
+}
+
+func (m *MemoryStore) ExtendRemoval(_ context.Context, userId int, name string, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, err := m.segment("segment", name)
+	if err != nil {
+		return err
+	}
+	key := planKey{membership{userId, segment.id}, OpRemove}
+	plan, ok := m.plans[key]
+	if !ok {
+		return ErrNotPlanned.blame("segment", name)
+	}
+	plan.stamp = at
+	m.plans[key] = plan
+	m.schedule.plan(plannedTask{stamp: at, userId: userId, segmentId: segment.id, operation: OpRemove})
+	return nil
+}
+
+func (m *MemoryStore) CancelRemoval(_ context.Context, userId int, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	segment, err := m.segment("segment", name)
+	if err != nil {
+		return err
+	}
+	key := planKey{membership{userId, segment.id}, OpRemove}
+	if _, ok := m.plans[key]; !ok {
+		return ErrNotPlanned.blame("segment", name)
+	}
+	delete(m.plans, key)
+	// Without the removal, a TTL-managed membership is an explicit one.
+	if member, ok := m.members[userId][segment.id]; ok && member.source == SourceTTL {
+		member.source = SourceExplicit
+		m.members[userId][segment.id] = member
+	}
+	m.schedule.forget(plannedTask{userId: userId, segmentId: segment.id, operation: OpRemove})
+	return nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Memberships in the past are replayed from operation_history: a user is in a
+// segment at a moment if the last operation on the membership by then is an
+// addition. Deletion of segments is not in the history, so segments deleted
+// by then have no users, unless they were deleted before the service recorded
+// the time of deletion.
+
+func (s *Store) GetSegmentsAsOf(ctx context.Context, userId int, at time.Time) ([]string, error) {
+	const qSegmentsAsOf = `
+select s.name
+from (
+   select distinct on (segment_id) segment_id, operation
+   from operation_history
+   where user_id = $1 and stamp <= $2
+   order by segment_id, stamp desc, id desc
+) last
+join segments s on s.id = last.segment_id
+where last.operation = 'add' and (s.deleted_at is null or s.deleted_at > $2)
+order by s.id;
+`
+	rows, err := s.db.QueryContext(ctx, qSegmentsAsOf, userId, at)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		segments = append(segments, name)
+	}
+	return segments, rows.Err()
+}
+
+func (m *MemoryStore) GetSegmentsAsOf(_ context.Context, userId int, at time.Time) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for key := range m.replay(at) {
+		if key.userId == userId {
+			ids = append(ids, key.segmentId)
+		}
+	}
+	sort.Ints(ids)
+
+	var segments []string
+	for _, id := range ids {
+		segments = append(segments, m.segments[id-1].name)
+	}
+	return segments, nil
+}
+
+// replay returns memberships at the given moment. Call with the mutex locked.
+func (m *MemoryStore) replay(at time.Time) map[membership]bool {
+	members := map[membership]bool{}
+	for _, op := range m.history {
+		if op.stamp.After(at) {
+			break // The history is in time order.
+		}
+		key := membership{op.userId, op.segmentId}
+		if op.operation == OpAdd {
+			members[key] = true
+		} else {
+			delete(members, key)
+		}
+	}
+	for key := range members {
+		if segment := m.segments[key.segmentId-1]; segment.deleted && !segment.deletedAt.After(at) {
+			delete(members, key)
+		}
+	}
+	return members
+}
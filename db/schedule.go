@@ -1,140 +1,496 @@
 package db
 
 import (
+	"container/heap"
 	"context"
 	"database/sql"
 	"log"
+	"sort"
+	"sync"
 	"time"
 )
 
-type removeTask struct {
-	ttl       int
+const (
+	// At most this many planned operations are kept in memory. The rest wait in
+	// the storage until their time comes closer.
+	scheduleCapacity = 10_000
+
+	// At most this many operations are carried out at once.
+	scheduleBatch = 500
+
+	// Wait this long before trying again when the storage fails.
+	scheduleRetry = time.Second
+
+	// Check the storage for due operations at least this often. They might be
+	// planned by other instances, including crashed ones.
+	schedulePoll = 5 * time.Second
+)
+
+type plannedTask struct {
+	stamp     time.Time
+	userId    int
+	segmentId int
+
+	// OpAdd or OpRemove. Empty for reminders, which only make the scheduler
+	// ask the backend at stamp.
+	operation string
+}
+
+// taskKey identifies the operation a task is planned for. The backend keeps
+// one plan per operation.
+type taskKey struct {
 	userId    int
 	segmentId int
+	operation string
 }
 
-var (
-	// Actors send many tasks to one queue simultaneously using planRemoval.
-	schedule = make(chan removeTask)
+func (t plannedTask) key() taskKey {
+	return taskKey{t.userId, t.segmentId, t.operation}
+}
 
-	// But we organize them and execute no more than one at any given time. Do not
-	// send here yourself.
-	queue = make(chan removeTask)
-)
+// planBackend is the storage of planned operations, i.e.
+// scheduled_operations. It is the source of truth, the scheduler only knows
+// when to ask it.
+type planBackend interface {
+	// upcomingPlans returns up to limit planned operations, earliest first.
+	upcomingPlans(ctx context.Context, limit int) ([]plannedTask, error)
 
-func startSchedule() {
-	go func() {
-		for task := range queue {
-			if err := removePerPlan(task.userId, task.segmentId); err != nil {
-				log.Println(err)
-			}
-		}
-	}()
-	go func() {
-		for task := range schedule {
-			go func(task removeTask) {
-				<-time.After(time.Second * time.Duration(task.ttl))
-				queue <- task
-			}(task)
+	// carryOutPlans carries out up to limit operations due by now, whoever
+	// planned them, forgets the plans and returns how many there were.
+	// Concurrent callers, possibly in other processes, never get the same plan.
+	carryOutPlans(ctx context.Context, now time.Time, limit int) (int, error)
+}
+
+// clock is time.Now and time.NewTimer. Tests substitute it to avoid sleeping.
+type clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) timer
+}
+
+type timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+
+func (t realTimer) Stop() bool { return t.t.Stop() }
+
+// taskHeap is a min-heap of tasks by stamp. See container/heap. It knows where
+// the task for every operation is, so that replaced tasks are dropped without
+// a scan. Reminders are not indexed, there may be any number of them.
+type taskHeap struct {
+	tasks []plannedTask
+	index map[taskKey]int
+}
+
+func (h *taskHeap) Len() int           { return len(h.tasks) }
+func (h *taskHeap) Less(i, j int) bool { return h.tasks[i].stamp.Before(h.tasks[j].stamp) }
+
+func (h *taskHeap) Swap(i, j int) {
+	h.tasks[i], h.tasks[j] = h.tasks[j], h.tasks[i]
+	h.reindex(i)
+	h.reindex(j)
+}
+
+func (h *taskHeap) Push(x any) {
+	h.tasks = append(h.tasks, x.(plannedTask))
+	h.reindex(len(h.tasks) - 1)
+}
+
+func (h *taskHeap) Pop() any {
+	task := h.tasks[len(h.tasks)-1]
+	h.tasks = h.tasks[:len(h.tasks)-1]
+	if task.operation != "" {
+		delete(h.index, task.key())
+	}
+	return task
+}
+
+func (h *taskHeap) reindex(i int) {
+	if task := h.tasks[i]; task.operation != "" {
+		if h.index == nil {
+			h.index = map[taskKey]int{}
 		}
-	}()
-	populateSchedule()
+		h.index[task.key()] = i
+	}
 }
 
-// This function is run at start up, so we crash on any error.
-func populateSchedule() {
-	const qSchedule = `
-select stamp, user_id, segment_id
-from delayed_removals
-`
-	rows, err := db.Query(qSchedule)
-	if err != nil {
-		log.Fatal(err)
+// add adds the task instead of the one for the same operation, if any.
+func (h *taskHeap) add(task plannedTask) {
+	h.remove(task)
+	heap.Push(h, task)
+}
+
+// remove removes the task for the same operation as task, if any.
+func (h *taskHeap) remove(task plannedTask) {
+	if task.operation == "" {
+		return
+	}
+	if i, ok := h.index[task.key()]; ok {
+		heap.Remove(h, i)
 	}
+}
 
-	var (
-		now   = time.Now()
-		tasks []removeTask
-	)
-	for rows.Next() {
-		var stamp time.Time
-		var task removeTask
-		if err = rows.Scan(&stamp, &task.userId, &task.segmentId); err != nil {
-			log.Fatal(err)
+// truncate leaves the n earliest tasks. Call it on a sorted heap.
+func (h *taskHeap) truncate(n int) {
+	for _, task := range h.tasks[n:] {
+		if task.operation != "" {
+			delete(h.index, task.key())
 		}
-		if now.After(stamp) {
-			task.ttl = -1
-		} else {
-			task.ttl = int(stamp.Sub(now).Seconds())
+	}
+	h.tasks = h.tasks[:n]
+}
+
+// scheduler carries out planned operations when their time comes. One goroutine
+// waits for the earliest task in a heap of no more than capacity tasks. If
+// there are more, the heap holds the earliest ones, that is every task before
+// horizon. The rest are loaded from the backend when the heap runs empty.
+//
+// When a task is due, the scheduler asks the backend to carry out everything
+// that is due. It also asks every schedulePoll, which covers tasks planned
+// by other instances after this one started.
+type scheduler struct {
+	backend  planBackend
+	clock    clock
+	capacity int
+
+	mu        sync.Mutex
+	tasks     taskHeap
+	truncated bool      // Whether the backend has tasks the heap does not.
+	horizon   time.Time // If truncated, the heap has every task before it.
+
+	wake     chan struct{} // Tells the loop the earliest task has changed.
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func newScheduler(backend planBackend, clock clock, capacity int) *scheduler {
+	return &scheduler{
+		backend:  backend,
+		clock:    clock,
+		capacity: capacity,
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// start loads the earliest tasks and starts waiting for them. It is run at
+// start up, so the caller fails on any error.
+func (s *scheduler) start(ctx context.Context) error {
+	if err := s.refill(ctx); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	log.Printf("Found %d scheduled tasks, more in storage: %v\n", s.tasks.Len(), s.truncated)
+	s.mu.Unlock()
+
+	go s.loop()
+	return nil
+}
+
+// close stops the scheduler and waits for the running operations to finish.
+// Planned operations stay in the backend.
+func (s *scheduler) close() {
+	// Stores are closed both explicitly and in deferred cleanup.
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// plan adds tasks planned in the backend already. They replace tasks for the
+// same operations, so that moved plans are not carried out at the old time.
+func (s *scheduler) plan(tasks ...plannedTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	earliest := s.earliest()
+	for _, task := range tasks {
+		if s.truncated && !task.stamp.Before(s.horizon) {
+			s.tasks.remove(task)
+			continue // The backend has it, we'll get to it later.
 		}
-		tasks = append(tasks, task)
+		s.tasks.add(task)
 	}
-	log.Printf("Found %d scheduled tasks\n", len(tasks))
+	if s.tasks.Len() > s.capacity {
+		s.shrink()
+	}
+	s.rewake(earliest)
+}
 
+// forget drops tasks whose plans are cancelled in the backend already.
+func (s *scheduler) forget(tasks ...plannedTask) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	earliest := s.earliest()
 	for _, task := range tasks {
-		if task.ttl <= 0 {
-			if err := removePerPlan(task.userId, task.segmentId); err != nil {
-				log.Fatal(err)
-			}
-		} else {
-			tx, err := db.Begin()
-			if err != nil {
-				log.Fatal(err)
+		s.tasks.remove(task)
+	}
+	s.rewake(earliest)
+}
+
+// earliest returns the stamp of the earliest task, zero if there are none.
+// Call with the mutex locked.
+func (s *scheduler) earliest() time.Time {
+	if s.tasks.Len() == 0 {
+		return time.Time{}
+	}
+	return s.tasks.tasks[0].stamp
+}
+
+// rewake tells the loop to wait for another task if the earliest one is not
+// at the given stamp anymore. Call with the mutex locked.
+func (s *scheduler) rewake(earliest time.Time) {
+	if s.earliest().Equal(earliest) {
+		return
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default: // The loop will wake up anyway.
+	}
+}
+
+// shrink leaves the earliest half of the tasks and moves the horizon
+// accordingly. Call with the mutex locked.
+func (s *scheduler) shrink() {
+	sort.Sort(&s.tasks) // A sorted slice is a valid heap.
+	keep := s.capacity / 2
+	s.horizon = s.tasks.tasks[keep].stamp
+	s.truncated = true
+	s.tasks.truncate(keep)
+}
+
+// refill loads the earliest tasks from the backend.
+func (s *scheduler) refill(ctx context.Context) error {
+	tasks, err := s.backend.upcomingPlans(ctx, s.capacity)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Tasks planned meanwhile might be loaded again, they replace themselves.
+	for _, task := range tasks {
+		s.tasks.add(task)
+	}
+	s.truncated = len(tasks) == s.capacity
+	if s.truncated {
+		s.horizon = tasks[len(tasks)-1].stamp
+	}
+	if s.tasks.Len() > s.capacity {
+		s.shrink()
+	}
+	return nil
+}
+
+// pause waits for d unless the scheduler is stopped. It returns false if it
+// is stopped.
+func (s *scheduler) pause(d time.Duration) bool {
+	t := s.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+func (s *scheduler) loop() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		needRefill := s.tasks.Len() == 0 && s.truncated
+		s.mu.Unlock()
+
+		if needRefill {
+			if err := s.refill(context.Background()); err != nil {
+				log.Println("Could not load scheduled tasks:", err)
+				if !s.pause(scheduleRetry) {
+					return
+				}
 			}
-			if err = planRemoval(context.Background(), tx, task.ttl, task.userId, task.segmentId); err != nil {
-				log.Fatal(err)
+			continue
+		}
+
+		s.mu.Lock()
+		wait := schedulePoll
+		if s.tasks.Len() > 0 {
+			if d := s.tasks.tasks[0].stamp.Sub(s.clock.Now()); d < wait {
+				wait = d
 			}
 		}
+		s.mu.Unlock()
+
+		t := s.clock.NewTimer(wait)
+		select {
+		case <-t.C():
+			s.fire()
+		case <-s.wake:
+		case <-s.stop:
+		}
+		t.Stop()
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
 	}
 }
 
-func planRemoval(ctx context.Context, tx *sql.Tx, ttl int, userId int, addToSegmentIds ...int) error {
-	const qPlan = `
-insert into delayed_removals (stamp, user_id, segment_id)
-values ($1, $2, $3)
-on conflict do nothing;
-`
+// fire forgets the due tasks and carries out everything due in batches.
+func (s *scheduler) fire() {
+	now := s.clock.Now()
 
-	eta := time.Now().Add(time.Duration(ttl) * time.Second)
+	s.mu.Lock()
+	for s.tasks.Len() > 0 && !s.tasks.tasks[0].stamp.After(now) {
+		heap.Pop(&s.tasks)
+	}
+	s.mu.Unlock()
 
-	for _, segmentId := range addToSegmentIds {
-		if _, err := tx.ExecContext(ctx, qPlan, eta, userId, segmentId); err != nil {
-			return err
+	for {
+		n, err := s.backend.carryOutPlans(context.Background(), now, scheduleBatch)
+		if err != nil {
+			log.Println("Could not carry out plans:", err)
+			// Try again later. A task with no user is just a reminder.
+			s.plan(plannedTask{stamp: now.Add(scheduleRetry)})
+			return
+		}
+		if n > 0 {
+			log.Printf("Carried out %d plans\n", n)
+		}
+		if n < scheduleBatch {
+			return
+		}
+		select {
+		case <-s.stop:
+			return
+		default:
 		}
 	}
+}
 
-	log.Printf("Planned %d tasks at %s", len(addToSegmentIds), eta)
+// planRemoval saves plans to remove the user from the segments after ttl
+// seconds instead of any planned removals, so that the newest TTL wins. Pass
+// the returned tasks to the schedule after commit.
+func planRemoval(ctx context.Context, tx *sql.Tx, ttl int, userId int, addToSegmentIds ...int) ([]plannedTask, error) {
+	const qPlan = `
+insert into scheduled_operations (stamp, user_id, segment_id, operation, source)
+values ($1, $2, $3, 'remove', 'ttl')
+on conflict (user_id, segment_id, operation) do update
+set stamp = excluded.stamp, source = excluded.source;
+`
 
+	var (
+		eta   = time.Now().Add(time.Duration(ttl) * time.Second)
+		tasks []plannedTask
+	)
 	for _, segmentId := range addToSegmentIds {
-		schedule <- removeTask{
-			ttl:       ttl,
+		if _, err := tx.ExecContext(ctx, qPlan, eta, userId, segmentId); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, plannedTask{
+			stamp:     eta,
 			userId:    userId,
 			segmentId: segmentId,
-		}
+			operation: OpRemove,
+		})
 	}
 
-	return nil
+	log.Printf("Planned %d tasks at %s", len(tasks), eta)
+	return tasks, nil
+}
+
+func (s *Store) upcomingPlans(ctx context.Context, limit int) ([]plannedTask, error) {
+	const qUpcoming = `
+select stamp, user_id, segment_id, operation
+from scheduled_operations
+order by stamp
+limit $1;
+`
+	rows, err := s.db.QueryContext(ctx, qUpcoming, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tasks []plannedTask
+	for rows.Next() {
+		var task plannedTask
+		if err = rows.Scan(&task.stamp, &task.userId, &task.segmentId, &task.operation); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
 }
 
-func removePerPlan(userId int, segmentId int) error {
-	log.Printf("Removing %d from %d as per plan\n", userId, segmentId)
+func (s *Store) carryOutPlans(ctx context.Context, now time.Time, limit int) (int, error) {
 	// Steps:
-	// 1. Delete
-	// 2. Update operation history
-	// 3. Update schedule
+	// 1. Lock due plans. Plans locked by other instances are skipped
+	// 2. Delete them
+	// 3. Of plans for the same membership, take the latest
+	// 4. Delete memberships for removals, add ones for additions like
+	//    qAddToSegment does
+	// 5. Update operation history
 	const q = `
-with deleted as (
-   delete from users_to_segments
-   where user_id = $1 and segment_id = $2
-   returning user_id, segment_id
+with due as (
+   select id
+   from scheduled_operations
+   where stamp <= $1
+   order by stamp
+   limit $2
+   for update skip locked
+), plans as (
+   delete from scheduled_operations so
+   using due
+   where so.id = due.id
+   returning so.stamp, so.user_id, so.segment_id, so.operation, so.source
+), latest as (
+   select distinct on (user_id, segment_id) user_id, segment_id, operation, source
+   from plans
+   order by user_id, segment_id, stamp desc
+), deleted as (
+   delete from users_to_segments uts
+   using latest
+   where latest.operation = 'remove'
+     and uts.user_id = latest.user_id and uts.segment_id = latest.segment_id
+   returning uts.user_id, uts.segment_id, latest.source
+), requested as (
+   update users_to_segments uts
+   set source = latest.source
+   from latest
+   where latest.operation = 'add'
+     and uts.user_id = latest.user_id and uts.segment_id = latest.segment_id
+     and uts.source = 'automatic'
+), added as (
+   insert into users_to_segments (user_id, segment_id, source)
+   select user_id, segment_id, source
+   from latest
+   where operation = 'add'
+   on conflict do nothing
+   returning user_id, segment_id, source
 ), history as (
-   insert into operation_history (user_id, segment_id, operation)
-	select user_id, segment_id, 'remove'
-	from deleted
+   insert into operation_history (user_id, segment_id, operation, source)
+   select user_id, segment_id, 'remove', source
+   from deleted
+   union all
+   select user_id, segment_id, 'add', source
+   from added
 )
-delete from delayed_removals
-where user_id = $1 and segment_id = $2;
+select count(*) from plans;
 `
-	_, err := db.Exec(q, userId, segmentId)
-	return err
+	var n int
+	err := s.db.QueryRowContext(ctx, q, now, limit).Scan(&n)
+	return n, err
 }
@@ -0,0 +1,284 @@
+package db
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	c       chan time.Time
+	at      time.Time
+	stopped bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.stopped = true
+	return true
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), at: c.now.Add(d)}
+	if d <= 0 {
+		t.c <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.at.After(c.now):
+			t.c <- c.now
+		default:
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+}
+
+// fakeBackend reports every expired task to the expired channel.
+type fakeBackend struct {
+	mu      sync.Mutex
+	planned map[membership]time.Time
+	expired chan plannedTask
+}
+
+func (b *fakeBackend) upcomingPlans(_ context.Context, limit int) ([]plannedTask, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var tasks []plannedTask
+	for key, stamp := range b.planned {
+		tasks = append(tasks, plannedTask{stamp, key.userId, key.segmentId, OpRemove})
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].stamp.Before(tasks[j].stamp) })
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+	}
+	return tasks, nil
+}
+
+func (b *fakeBackend) carryOutPlans(ctx context.Context, now time.Time, limit int) (int, error) {
+	tasks, _ := b.upcomingPlans(ctx, limit)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, task := range tasks {
+		if task.stamp.After(now) {
+			break
+		}
+		delete(b.planned, membership{task.userId, task.segmentId})
+		b.expired <- task
+		n++
+	}
+	return n, nil
+}
+
+func (b *fakeBackend) expect(t *testing.T, userIds ...int) {
+	t.Helper()
+	for _, want := range userIds {
+		select {
+		case task := <-b.expired:
+			if task.userId != want {
+				t.Errorf("expired user %d, want %d", task.userId, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("user %d did not expire", want)
+		}
+	}
+	select {
+	case task := <-b.expired:
+		t.Errorf("unexpected expiry of user %d", task.userId)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	var (
+		start   = time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+		clock   = &fakeClock{now: start}
+		backend = &fakeBackend{
+			planned: map[membership]time.Time{},
+			expired: make(chan plannedTask, 100),
+		}
+		at = func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	)
+	// Users 1 to 10 are planned before the start, user n at n seconds.
+	for userId := 1; userId <= 10; userId++ {
+		backend.planned[membership{userId, 1}] = at(userId)
+	}
+
+	// The heap is smaller than the number of tasks, so they are loaded in
+	// portions.
+	s := newScheduler(backend, clock, 4)
+	if err := s.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	if s.tasks.Len() != 4 || !s.truncated {
+		t.Fatalf("loaded %d tasks, truncated: %v, want 4, true", s.tasks.Len(), s.truncated)
+	}
+
+	clock.Advance(2 * time.Second)
+	backend.expect(t, 1, 2)
+
+	// Earlier than everything in the heap.
+	backend.mu.Lock()
+	backend.planned[membership{100, 1}] = at(2)
+	backend.mu.Unlock()
+	s.plan(plannedTask{at(2), 100, 1, OpRemove})
+	backend.expect(t, 100)
+
+	// Beyond the horizon, the backend has it and it waits there.
+	backend.mu.Lock()
+	backend.planned[membership{200, 1}] = at(6).Add(time.Second / 2)
+	backend.mu.Unlock()
+	s.plan(plannedTask{at(6).Add(time.Second / 2), 200, 1, OpRemove})
+	s.mu.Lock()
+	if n := s.tasks.Len(); n != 2 {
+		t.Errorf("got %d tasks in the heap, want 2", n)
+	}
+	s.mu.Unlock()
+
+	clock.Advance(5 * time.Second)
+	backend.expect(t, 3, 4, 5, 6, 200, 7)
+
+	clock.Advance(time.Hour)
+	backend.expect(t, 8, 9, 10)
+}
+
+func TestSchedulerMoves(t *testing.T) {
+	var (
+		start   = time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+		clock   = &fakeClock{now: start}
+		backend = &fakeBackend{
+			planned: map[membership]time.Time{},
+			expired: make(chan plannedTask, 100),
+		}
+		at = func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	)
+	s := newScheduler(backend, clock, 10)
+	if err := s.start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	for userId := 1; userId <= 2; userId++ {
+		backend.mu.Lock()
+		backend.planned[membership{userId, 1}] = at(userId)
+		backend.mu.Unlock()
+		s.plan(plannedTask{at(userId), userId, 1, OpRemove})
+	}
+
+	// User 1 is moved after user 2, and the old task is gone.
+	backend.mu.Lock()
+	backend.planned[membership{1, 1}] = at(3)
+	backend.mu.Unlock()
+	s.plan(plannedTask{at(3), 1, 1, OpRemove})
+	s.mu.Lock()
+	if n := s.tasks.Len(); n != 2 {
+		t.Errorf("got %d tasks in the heap, want 2", n)
+	}
+	s.mu.Unlock()
+
+	clock.Advance(2 * time.Second)
+	backend.expect(t, 2)
+
+	// Cancelled plans leave nothing behind.
+	backend.mu.Lock()
+	delete(backend.planned, membership{1, 1})
+	backend.mu.Unlock()
+	s.forget(plannedTask{userId: 1, segmentId: 1, operation: OpRemove})
+	s.mu.Lock()
+	if n := s.tasks.Len(); n != 0 {
+		t.Errorf("got %d tasks in the heap, want none", n)
+	}
+	s.mu.Unlock()
+
+	clock.Advance(time.Hour)
+	backend.expect(t)
+}
+
+func TestTaskHeap(t *testing.T) {
+	start := time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	check := func(h *taskHeap, want int) {
+		t.Helper()
+		if h.Len() != want {
+			t.Fatalf("got %d tasks, want %d", h.Len(), want)
+		}
+		indexed := 0
+		for i, task := range h.tasks {
+			if task.operation == "" {
+				continue
+			}
+			indexed++
+			if h.index[task.key()] != i {
+				t.Fatalf("task %v is at %d, index says %d", task, i, h.index[task.key()])
+			}
+			if i > 0 && h.Less(i, (i-1)/2) {
+				t.Fatalf("task %v is earlier than its parent", task)
+			}
+		}
+		if len(h.index) != indexed {
+			t.Fatalf("got %d indexed tasks, want %d", len(h.index), indexed)
+		}
+	}
+
+	var h taskHeap
+	for i := 0; i < 100; i++ {
+		// Stamps go back and forth, so tasks move around.
+		stamp := start.Add(time.Duration(i*37%100) * time.Second)
+		h.add(plannedTask{stamp, i % 10, 1, OpRemove})
+		h.add(plannedTask{stamp, i % 10, 1, OpAdd})
+	}
+	check(&h, 20)
+
+	// Reminders are neither replaced nor removed.
+	h.add(plannedTask{stamp: start})
+	h.add(plannedTask{stamp: start})
+	h.remove(plannedTask{stamp: start})
+	check(&h, 22)
+
+	for userId := 0; userId < 5; userId++ {
+		h.remove(plannedTask{userId: userId, segmentId: 1, operation: OpRemove})
+	}
+	check(&h, 17)
+
+	sort.Sort(&h)
+	h.truncate(8)
+	check(&h, 8)
+	for h.Len() > 0 {
+		heap.Pop(&h)
+	}
+	check(&h, 0)
+}
@@ -0,0 +1,420 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/lib/pq"
+)
+
+// qSegmentInfo selects columns for scanSegmentInfo. Plans count only if the
+// user is still in the segment.
+const qSegmentInfo = `
+select s.id, s.name, s.automatic_percent, coalesce(s.deleted, false), coalesce(s.salt, ''),
+   s.created_at, s.deleted_at,
+   s.description, s.owner, s.tags, s.attributes,
+   (select count(*) from users_to_segments uts where uts.segment_id = s.id),
+   (select count(*)
+    from scheduled_operations so
+    join users_to_segments uts on uts.user_id = so.user_id and uts.segment_id = so.segment_id
+    where so.segment_id = s.id and so.operation = 'remove')
+from segments s
+`
+
+func scanSegmentInfo(row interface{ Scan(...any) error }) (SegmentInfo, error) {
+	var (
+		info                 SegmentInfo
+		createdAt, deletedAt sql.NullTime
+		attributes           []byte // Scanning into json.RawMessage does not copy.
+	)
+	err := row.Scan(
+		&info.Id, &info.Name, &info.AutomaticPercent, &info.Deleted, &info.Salt, &createdAt, &deletedAt,
+		&info.Description, &info.Owner, pq.Array(&info.Tags), &attributes,
+		&info.Members, &info.PendingRemovals,
+	)
+	if err != nil {
+		return info, err
+	}
+	info.CreatedAt, info.DeletedAt = createdAt.Time, deletedAt.Time
+	info.Attributes = attributes
+	info.SegmentMeta, err = info.SegmentMeta.normalize(info.Name)
+	return info, err
+}
+
+func (s *Store) ListSegments(ctx context.Context, filter SegmentFilter) ([]SegmentInfo, error) {
+	tx, err := s.db.BeginTx(ctx, optsRO)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const qList = qSegmentInfo + `
+where s.id > $1
+  and ($2::boolean is null or coalesce(s.deleted, false) = $2)
+  and left(s.name, length($3)) = $3 -- Unlike like, no characters are special
+  and ($5::text = '' or s.tags @> array[$5::text])
+order by s.id
+limit $4; -- Null means no limit
+`
+	var (
+		deleted = sql.NullBool{Valid: filter.Deleted != nil}
+		limit   = sql.NullInt64{Int64: int64(filter.Limit), Valid: filter.Limit > 0}
+	)
+	if filter.Deleted != nil {
+		deleted.Bool = *filter.Deleted
+	}
+
+	rows, err := tx.QueryContext(ctx, qList, filter.After, deleted, filter.Prefix, limit, filter.Tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []SegmentInfo
+	for rows.Next() {
+		info, err := scanSegmentInfo(rows)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, info)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return segments, tx.Commit()
+}
+
+func (s *Store) InspectSegment(ctx context.Context, name string) (SegmentInfo, error) {
+	tx, err := s.db.BeginTx(ctx, optsRO)
+	if err != nil {
+		return SegmentInfo{}, err
+	}
+	defer tx.Rollback()
+
+	const qInspect = qSegmentInfo + `where s.name = $1;`
+	info, err := scanSegmentInfo(tx.QueryRowContext(ctx, qInspect, name))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return SegmentInfo{}, ErrNameFree.blame("name", name)
+	case err != nil:
+		return SegmentInfo{}, err
+	}
+	return info, tx.Commit()
+}
+
+func (s *Store) ListMembers(ctx context.Context, name string, filter MemberFilter, fn func(userId int) error) error {
+	tx, err := s.db.BeginTx(ctx, optsRO)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Deleted segments have no members, so they are fine.
+	const qId = `select id from segments where name = $1;`
+	var id int
+	switch err = tx.QueryRowContext(ctx, qId, name).Scan(&id); {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNameFree.blame("name", name)
+	case err != nil:
+		return err
+	}
+
+	const (
+		qMembers = `
+select user_id
+from users_to_segments
+where segment_id = $1 and ($2::integer is null or user_id > $2)
+order by user_id
+limit $3; -- Null means no limit
+`
+		// See replay.go.
+		qMembersAsOf = `
+select last.user_id
+from (
+   select distinct on (user_id) user_id, operation
+   from operation_history
+   where segment_id = $1 and ($2::integer is null or user_id > $2) and stamp <= $4
+   order by user_id, stamp desc, id desc
+) last
+join segments s on s.id = $1
+where last.operation = 'add' and (s.deleted_at is null or s.deleted_at > $4)
+order by last.user_id
+limit $3; -- Null means no limit
+`
+	)
+	var (
+		after = sql.NullInt64{Valid: filter.After != nil}
+		limit = sql.NullInt64{Int64: int64(filter.Limit), Valid: filter.Limit > 0}
+	)
+	if filter.After != nil {
+		after.Int64 = int64(*filter.After)
+	}
+
+	var rows *sql.Rows
+	if filter.AsOf != nil {
+		rows, err = tx.QueryContext(ctx, qMembersAsOf, id, after, limit, *filter.AsOf)
+	} else {
+		rows, err = tx.QueryContext(ctx, qMembers, id, after, limit)
+	}
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var userId int
+		if err = rows.Scan(&userId); err != nil {
+			return err
+		}
+		if err = fn(userId); err != nil {
+			return err
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) UpdateSegment(ctx context.Context, name string, update SegmentUpdate) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const qMeta = `
+select id, deleted, automatic_percent, coalesce(salt, ''), description, owner, tags, attributes
+from segments
+where name = $1
+for update;
+`
+	var (
+		id         int
+		deleted    bool
+		percent    uint
+		salt       string
+		meta       SegmentMeta
+		attributes []byte
+	)
+	err = tx.QueryRowContext(ctx, qMeta, name).Scan(
+		&id, &deleted, &percent, &salt, &meta.Description, &meta.Owner, pq.Array(&meta.Tags), &attributes,
+	)
+	meta.Attributes = attributes
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNameFree.blame("name", name)
+	case err != nil:
+		return err
+	case deleted:
+		return ErrSegmentDeleted.blame("name", name)
+	}
+
+	updatedPercent, meta, changes, err := update.apply(name, percent, meta)
+	if err != nil || len(changes) == 0 {
+		return err
+	}
+
+	const (
+		qUpdate = `
+update segments
+set automatic_percent = $2, description = $3, owner = $4, tags = $5, attributes = $6
+where id = $1;
+`
+		qRecord = `
+insert into segment_changes (segment_id, field, old_value, new_value)
+values ($1, $2, $3, $4);
+`
+	)
+	_, err = tx.ExecContext(ctx, qUpdate,
+		id, updatedPercent, meta.Description, meta.Owner, pq.Array(meta.Tags), string(meta.Attributes),
+	)
+	if err != nil {
+		return err
+	}
+	if err = ramp(ctx, tx, id, salt, percent, updatedPercent); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		_, err = tx.ExecContext(ctx, qRecord, id, change.Field, string(change.Old), string(change.New))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Store) SegmentChanges(ctx context.Context, name string) ([]SegmentChange, error) {
+	tx, err := s.db.BeginTx(ctx, optsRO)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	const qChanges = `
+select sc.stamp, sc.field, sc.old_value, sc.new_value
+from segment_changes sc
+join segments s on s.id = sc.segment_id
+where s.name = $1
+order by sc.id;
+`
+	rows, err := tx.QueryContext(ctx, qChanges, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []SegmentChange{}
+	for rows.Next() {
+		var (
+			change        SegmentChange
+			before, after []byte
+		)
+		if err = rows.Scan(&change.Stamp, &change.Field, &before, &after); err != nil {
+			return nil, err
+		}
+		if change.Old, err = canonicalJSON(before); err != nil {
+			return nil, err
+		}
+		if change.New, err = canonicalJSON(after); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// No changes might mean no segment.
+	if len(changes) == 0 {
+		const qExists = `select exists (select from segments where name = $1);`
+		var exists bool
+		if err = tx.QueryRowContext(ctx, qExists, name).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrNameFree.blame("name", name)
+		}
+	}
+	return changes, tx.Commit()
+}
+
+// enroll adds the fraction of known users that are not in the segment to it
+// automatically. Users are chosen randomly.
+func enroll(ctx context.Context, tx *sql.Tx, segmentId int, fraction float64) error {
+	const qEnroll = `
+with known as ( -- Known users that are not in the segment
+   select distinct user_id
+   from users_to_segments uts
+   where not exists (
+      select from users_to_segments
+      where segment_id = $1 and user_id = uts.user_id
+   )
+), percented as ( -- Get user with percent value
+   select user_id, percent_rank() over (order by random())
+   from known
+), sample as ( -- Get the fraction of users according to the percent rank
+   select user_id from percented
+   where percent_rank < $2::float8
+      or $2::float8 >= 1 -- The last user's rank is exactly 1
+), written as (
+   insert into users_to_segments (user_id, segment_id, source)
+   select user_id, $1, 'automatic'
+   from sample
+   on conflict do nothing
+   returning user_id, segment_id
+)
+insert into operation_history (user_id, segment_id, operation, source)
+select user_id, segment_id, 'add', 'automatic'
+from written;
+`
+	_, err := tx.ExecContext(ctx, qEnroll, segmentId, fraction)
+	return err
+}
+
+// unenroll removes users that got into the segment automatically, except for
+// the fraction to keep. Users are chosen randomly.
+func unenroll(ctx context.Context, tx *sql.Tx, segmentId int, keep float64) error {
+	const qUnenroll = `
+with percented as ( -- Get automatically added user with percent value
+   select user_id, percent_rank() over (order by random())
+   from users_to_segments
+   where segment_id = $1 and source = 'automatic'
+), deleted as ( -- Keep the fraction of users according to the percent rank
+   delete from users_to_segments uts
+   using percented
+   where uts.segment_id = $1 and uts.user_id = percented.user_id
+     and percented.percent_rank >= $2::float8
+   returning uts.user_id, uts.segment_id
+)
+insert into operation_history (user_id, segment_id, operation, source)
+select user_id, segment_id, 'remove', 'automatic'
+from deleted;
+`
+	_, err := tx.ExecContext(ctx, qUnenroll, segmentId, keep)
+	return err
+}
+
+// enrollBuckets adds known users that are not in the segment to it
+// automatically if their buckets are below the percent.
+func enrollBuckets(ctx context.Context, tx *sql.Tx, segmentId int, salt string, percent uint) error {
+	const qEnroll = `
+with known as ( -- Known users that are not in the segment
+   select distinct user_id
+   from users_to_segments uts
+   where not exists (
+      select from users_to_segments
+      where segment_id = $1 and user_id = uts.user_id
+   )
+), written as (
+   insert into users_to_segments (user_id, segment_id, source)
+   select user_id, $1, 'automatic'
+   from known
+   where segment_bucket($2, user_id) < $3 * 100
+   on conflict do nothing
+   returning user_id, segment_id
+)
+insert into operation_history (user_id, segment_id, operation, source)
+select user_id, segment_id, 'add', 'automatic'
+from written;
+`
+	_, err := tx.ExecContext(ctx, qEnroll, segmentId, salt, percent)
+	return err
+}
+
+// unenrollBuckets removes users that got into the segment automatically if
+// their buckets are not below the percent.
+func unenrollBuckets(ctx context.Context, tx *sql.Tx, segmentId int, salt string, percent uint) error {
+	const qUnenroll = `
+with deleted as (
+   delete from users_to_segments
+   where segment_id = $1 and source = 'automatic' and segment_bucket($2, user_id) >= $3 * 100
+   returning user_id, segment_id
+)
+insert into operation_history (user_id, segment_id, operation, source)
+select user_id, segment_id, 'remove', 'automatic'
+from deleted;
+`
+	_, err := tx.ExecContext(ctx, qUnenroll, segmentId, salt, percent)
+	return err
+}
+
+// ramp enrolls or unenrolls users when the automatic percent changes, so that
+// the segment has about the new percent of known users. Segments with a salt
+// choose users by their buckets instead of randomly.
+func ramp(ctx context.Context, tx *sql.Tx, segmentId int, salt string, from, to uint) error {
+	switch {
+	case to > from && salt != "":
+		return enrollBuckets(ctx, tx, segmentId, salt, to)
+	case to < from && salt != "":
+		return unenrollBuckets(ctx, tx, segmentId, salt, to)
+	case to > from:
+		// Users out of the segment are 100 - from percent of all. Enroll
+		// enough of them to make up the difference.
+		return enroll(ctx, tx, segmentId, float64(to-from)/float64(100-from))
+	case to < from:
+		return unenroll(ctx, tx, segmentId, float64(to)/float64(from))
+	}
+	return nil
+}
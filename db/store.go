@@ -0,0 +1,153 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// SegmentStore is everything package web needs from storage. Store keeps the
+// data in Postgres, MemoryStore keeps it in memory. Both behave the same way
+// and return the same errors.
+type SegmentStore interface {
+	// CreateSegment creates a segment. If salt is set, automatic members are
+	// chosen by Bucket instead of randomly.
+	CreateSegment(ctx context.Context, name string, percent uint, salt string, meta SegmentMeta) error
+
+	DeleteSegment(ctx context.Context, name string) error
+
+	// UpdateUser adds the user to segments and removes them from others. With
+	// TTL, the user is removed from the added segments after ttl seconds.
+	// Plans replace earlier plans of the same operation for their segments,
+	// including removals after TTL. See Plan.Source for per-segment TTL.
+	UpdateUser(ctx context.Context, userId int, addTo []string, removeFrom []string, ttl int, plans ...Plan) error
+
+	// GetPlans returns operations planned for the user, earliest first.
+	GetPlans(ctx context.Context, userId int) ([]Plan, error)
+
+	// ListRemovals calls fn for removals planned from the segment matching
+	// the filter, earliest first, then by user id, and stops at the first
+	// error fn returns.
+	ListRemovals(ctx context.Context, name string, filter RemovalFilter, fn func(removal Removal) error) error
+
+	// ExtendRemoval moves the planned removal of the user from the segment to
+	// at, earlier or later. It fails with ErrNotPlanned if there is none.
+	ExtendRemoval(ctx context.Context, userId int, name string, at time.Time) error
+
+	// CancelRemoval forgets the planned removal of the user from the segment,
+	// so the user stays there. It fails with ErrNotPlanned if there is none.
+	CancelRemoval(ctx context.Context, userId int, name string) error
+
+	// UpdateUsers applies rows like UpdateUser, but for many users at once in
+	// one transaction. If several rows are for the same user and segment, the
+	// last one wins. Rows that cannot be applied are reported in the result
+	// and do not stop the rest.
+	UpdateUsers(ctx context.Context, rows *BulkReader) (BulkResult, error)
+
+	GetSegments(ctx context.Context, userId int) ([]string, error)
+
+	// GetSegmentsAsOf returns segments the user was in at the given moment,
+	// replayed from the history.
+	GetSegmentsAsOf(ctx context.Context, userId int, at time.Time) ([]string, error)
+
+	// GetSegmentsBatch is GetSegments for many users in one query. Every
+	// given user is in the result, with no segments if need be.
+	GetSegmentsBatch(ctx context.Context, userIds []int) (map[int][]string, error)
+
+	// GetMemberships is GetSegments with details: how and when the user got
+	// into each segment, and when the TTL runs out.
+	GetMemberships(ctx context.Context, userId int) ([]Membership, error)
+
+	// GetHistory calls fn for operations matching the filter, oldest first,
+	// and stops at the first error fn returns.
+	GetHistory(ctx context.Context, filter HistoryFilter, fn func(record HistoryRecord) error) error
+
+	// ListSegments returns segments matching the filter ordered by id.
+	ListSegments(ctx context.Context, filter SegmentFilter) ([]SegmentInfo, error)
+
+	// UpdateSegment changes the segment and records every changed field.
+	UpdateSegment(ctx context.Context, name string, update SegmentUpdate) error
+
+	// SegmentChanges returns changes of the segment, deleted or not, oldest
+	// first.
+	SegmentChanges(ctx context.Context, name string) ([]SegmentChange, error)
+
+	// InspectSegment returns the segment with the given name, deleted or not.
+	InspectSegment(ctx context.Context, name string) (SegmentInfo, error)
+
+	// ListMembers calls fn for users in the segment matching the filter in
+	// user_id order, and stops at the first error fn returns. Deleted segments
+	// have no users.
+	ListMembers(ctx context.Context, name string, filter MemberFilter, fn func(userId int) error) error
+}
+
+var (
+	_ SegmentStore = (*Store)(nil)
+	_ SegmentStore = (*MemoryStore)(nil)
+)
+
+// SegmentFilter chooses segments for ListSegments. The zero value chooses all.
+type SegmentFilter struct {
+	// If set, only deleted or only active segments.
+	Deleted *bool
+
+	// Only segments whose names start with it.
+	Prefix string
+
+	// If set, only segments with this tag.
+	Tag string
+
+	// Only segments with greater ids. Pass the last id of the previous page.
+	After int
+
+	// At most this many segments. Zero means no limit.
+	Limit int
+}
+
+// SegmentInfo describes a segment.
+type SegmentInfo struct {
+	Id               int
+	Name             string
+	AutomaticPercent uint
+	Deleted          bool
+
+	// Empty if automatic members are chosen randomly. See Bucket.
+	Salt string
+
+	SegmentMeta
+
+	// Zero for segments created before it was recorded.
+	CreatedAt time.Time
+
+	// Zero for active segments and ones deleted before it was recorded.
+	DeletedAt time.Time
+
+	// Users in the segment now.
+	Members int
+
+	// Users to be removed from the segment when their TTL runs out.
+	PendingRemovals int
+}
+
+// RemovalFilter selects a page of planned removals for ListRemovals.
+type RemovalFilter struct {
+	// If set, only removals after it, later or at the same time of users with
+	// greater ids. Pass the last removal of the previous page.
+	After *Removal
+
+	// At most this many removals. Zero means no limit.
+	Limit int
+}
+
+// MemberFilter chooses users for ListMembers. The zero value chooses all.
+type MemberFilter struct {
+	// If set, only users with greater ids. Pass the last id of the previous
+	// page.
+	After *int
+
+	// At most this many users. Zero means no limit.
+	Limit int
+
+	// If set, users who were in the segment at that moment, replayed from
+	// the history, rather than the current ones.
+	AsOf *time.Time
+}
@@ -0,0 +1,997 @@
+package db
+
+import (
+	"avito2023/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The conformance suite runs against MemoryStore always and against Store when
+// TEST_BACKEND=postgres. The database is configured like the server, see
+// package config. It does not have to be empty: the suite uses fresh names and
+// ids and ignores foreign segments.
+
+type fixture struct {
+	store  SegmentStore
+	prefix string
+	userId int
+}
+
+func (f *fixture) name(s string) string {
+	return f.prefix + s
+}
+
+func (f *fixture) user(n int) int {
+	return f.userId + n
+}
+
+// segments returns the user's segments created by this suite, sorted.
+func (f *fixture) segments(t *testing.T, userId int) []string {
+	t.Helper()
+	all, err := f.store.GetSegments(context.Background(), userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ours []string
+	for _, name := range all {
+		if strings.HasPrefix(name, f.prefix) {
+			ours = append(ours, strings.TrimPrefix(name, f.prefix))
+		}
+	}
+	sort.Strings(ours)
+	return ours
+}
+
+func (f *fixture) expectSegments(t *testing.T, userId int, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	got := f.segments(t, userId)
+	if len(got) == 0 && len(want) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("user %d: got segments %q, want %q", userId, got, want)
+	}
+}
+
+// expectSources checks sources of the user's memberships in segments created
+// by this suite. Keys of want are segment names without the prefix.
+func (f *fixture) expectSources(t *testing.T, userId int, want map[string]string) {
+	t.Helper()
+	memberships, err := f.store.GetMemberships(context.Background(), userId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, membership := range memberships {
+		if strings.HasPrefix(membership.Segment, f.prefix) {
+			got[strings.TrimPrefix(membership.Segment, f.prefix)] = membership.Source
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("user %d: got sources %v, want %v", userId, got, want)
+	}
+}
+
+func expectErr(t *testing.T, got, want error) {
+	t.Helper()
+	if !errors.Is(got, want) {
+		t.Errorf("got error %v, want %v", got, want)
+	}
+}
+
+func expectBlame(t *testing.T, err error, field, segment string) {
+	t.Helper()
+	var e *Error
+	if !errors.As(err, &e) || e.Field != field || e.Segment != segment {
+		t.Errorf("got error %#v, want it to blame segment %q from %s", err, segment, field)
+	}
+}
+
+func testConformance(t *testing.T, store SegmentStore) {
+	var (
+		ctx = context.Background()
+		f   = &fixture{
+			store:  store,
+			prefix: fmt.Sprintf("conformance %d ", time.Now().UnixNano()),
+			userId: 1_000_000 + rand.Intn(1_000_000_000),
+		}
+	)
+
+	// Automatic segments and pending removals of this suite would leak into
+	// other tests sharing the database.
+	t.Cleanup(func() {
+		for _, name := range []string{"retro", "infect", "list/1", "bucket"} {
+			_ = store.DeleteSegment(ctx, f.name(name))
+		}
+	})
+
+	t.Run("CreateSegment", func(t *testing.T) {
+		expectErr(t, store.CreateSegment(ctx, "", 0, "", SegmentMeta{}), ErrNameEmpty)
+		expectErr(t, store.CreateSegment(ctx, f.name("bad"), 101, "", SegmentMeta{}), ErrBadPercent)
+		expectErr(t, store.CreateSegment(ctx, f.name("a"), 0, "", SegmentMeta{}), nil)
+		expectErr(t, store.CreateSegment(ctx, f.name("b"), 0, "", SegmentMeta{}), nil)
+		expectErr(t, store.CreateSegment(ctx, f.name("a"), 0, "", SegmentMeta{}), ErrNameTaken)
+	})
+
+	t.Run("DeleteSegment", func(t *testing.T) {
+		expectErr(t, store.CreateSegment(ctx, f.name("doomed"), 0, "", SegmentMeta{}), nil)
+		expectErr(t, store.DeleteSegment(ctx, f.name("doomed")), nil)
+		expectErr(t, store.DeleteSegment(ctx, f.name("doomed")), ErrSegmentDeleted)
+		expectErr(t, store.DeleteSegment(ctx, f.name("never existed")), ErrNameFree)
+		expectErr(t, store.CreateSegment(ctx, f.name("doomed"), 0, "", SegmentMeta{}), ErrNameTaken)
+	})
+
+	t.Run("UpdateUser", func(t *testing.T) {
+		u := f.user(1)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("doomed")}, nil, 0), ErrSegmentDeleted)
+		err := store.UpdateUser(ctx, u, []string{f.name("a"), f.name("never existed")}, nil, 0)
+		expectErr(t, err, ErrNameFree)
+		expectBlame(t, err, "add_to_segments", f.name("never existed"))
+		f.expectSegments(t, u) // Nothing changes on error.
+
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("a"), f.name("b")}, nil, 0), nil)
+		f.expectSegments(t, u, "a", "b")
+
+		// Adding twice changes nothing.
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("a"), f.name("a")}, nil, 0), nil)
+		f.expectSegments(t, u, "a", "b")
+
+		expectErr(t, store.UpdateUser(ctx, u, nil, []string{f.name("b")}, 0), nil)
+		f.expectSegments(t, u, "a")
+
+		// Removing what is not there changes nothing.
+		expectErr(t, store.UpdateUser(ctx, u, nil, []string{f.name("b")}, 0), nil)
+		f.expectSegments(t, u, "a")
+
+		err = store.UpdateUser(ctx, u, nil, []string{f.name("never existed")}, 0)
+		expectErr(t, err, ErrNameFree)
+		expectBlame(t, err, "remove_from_segments", f.name("never existed"))
+
+		// Deleted segments vanish from users.
+		expectErr(t, store.CreateSegment(ctx, f.name("short-lived"), 0, "", SegmentMeta{}), nil)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("short-lived")}, nil, 0), nil)
+		expectErr(t, store.DeleteSegment(ctx, f.name("short-lived")), nil)
+		f.expectSegments(t, u, "a")
+	})
+
+	t.Run("AutomaticPercent", func(t *testing.T) {
+		known, unknown := f.user(2), f.user(3)
+		expectErr(t, store.UpdateUser(ctx, known, []string{f.name("a")}, nil, 0), nil)
+
+		// Every known user gets into a 100% segment retroactively...
+		expectErr(t, store.CreateSegment(ctx, f.name("retro"), 100, "", SegmentMeta{}), nil)
+		f.expectSegments(t, known, "a", "retro")
+		f.expectSegments(t, unknown)
+
+		// ...and every new one gets there upon the first update.
+		expectErr(t, store.CreateSegment(ctx, f.name("infect"), 100, "", SegmentMeta{}), nil)
+		expectErr(t, store.UpdateUser(ctx, unknown, nil, nil, 0), nil)
+		f.expectSegments(t, unknown, "retro", "infect")
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		u := f.user(4)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("a"), f.name("b")}, nil, 1), nil)
+		f.expectSegments(t, u, "a", "b", "infect", "retro")
+
+		time.Sleep(1500 * time.Millisecond)
+		f.expectSegments(t, u, "infect", "retro")
+	})
+
+	t.Run("Sources", func(t *testing.T) {
+		u := f.user(7)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("a")}, nil, 0), nil)
+		f.expectSources(t, u, map[string]string{
+			"a": SourceExplicit, "retro": SourceAutomatic, "infect": SourceAutomatic,
+		})
+
+		// A request makes an automatic membership explicit, TTL makes any
+		// membership TTL-managed, and a request without TTL does not undo it.
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("infect")}, nil, 0), nil)
+		before := time.Now()
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("retro")}, nil, 3600), nil)
+		after := time.Now()
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("retro")}, nil, 0), nil)
+		f.expectSources(t, u, map[string]string{
+			"a": SourceExplicit, "retro": SourceTTL, "infect": SourceExplicit,
+		})
+
+		memberships, err := store.GetMemberships(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, membership := range memberships {
+			if !strings.HasPrefix(membership.Segment, f.prefix) {
+				continue
+			}
+			if membership.JoinedAt.IsZero() || membership.JoinedAt.After(after) {
+				t.Errorf("%s: joined at %v, want before %v", membership.Segment, membership.JoinedAt, after)
+			}
+			switch expires := membership.ExpiresAt; {
+			case membership.Segment != f.name("retro"):
+				if !expires.IsZero() {
+					t.Errorf("%s: expires at %v, want never", membership.Segment, expires)
+				}
+			case expires.Before(before.Add(time.Hour).Truncate(time.Millisecond)) || expires.After(after.Add(time.Hour)):
+				t.Errorf("%s: expires at %v, want in an hour", membership.Segment, expires)
+			}
+		}
+	})
+
+	t.Run("Plans", func(t *testing.T) {
+		u := f.user(11)
+		err := store.UpdateUser(ctx, u, nil, nil, 0, Plan{Segment: f.name("doomed"), Operation: OpAdd, At: time.Now()})
+		expectErr(t, err, ErrSegmentDeleted)
+		expectBlame(t, err, "add_at", f.name("doomed"))
+		err = store.UpdateUser(ctx, u, nil, nil, 0, Plan{Segment: f.name("never existed"), Operation: OpRemove, At: time.Now()})
+		expectErr(t, err, ErrNameFree)
+		expectBlame(t, err, "remove_at", f.name("never existed"))
+
+		// A later plan for the same operation replaces the earlier one.
+		later := time.Now().Add(2 * time.Hour).Truncate(time.Millisecond)
+		expectErr(t, store.UpdateUser(ctx, u, nil, nil, 0,
+			Plan{Segment: f.name("retro"), Operation: OpRemove, At: later.Add(-time.Hour)}), nil)
+		expectErr(t, store.UpdateUser(ctx, u, nil, nil, 0,
+			Plan{Segment: f.name("retro"), Operation: OpRemove, At: later}), nil)
+
+		start := time.Now().Truncate(time.Millisecond)
+		expectErr(t, store.UpdateUser(ctx, u, nil, nil, 0,
+			Plan{Segment: f.name("a"), Operation: OpAdd, At: start.Add(500 * time.Millisecond)},
+			Plan{Segment: f.name("a"), Operation: OpRemove, At: start.Add(time.Second)},
+		), nil)
+		plans, err := store.GetPlans(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []Plan{
+			{f.name("a"), OpAdd, start.Add(500 * time.Millisecond), SourceExplicit},
+			{f.name("a"), OpRemove, start.Add(time.Second), SourceExplicit},
+			{f.name("retro"), OpRemove, later, SourceExplicit},
+		}
+		if len(plans) != len(want) {
+			t.Fatalf("got plans %v, want %v", plans, want)
+		}
+		for i := range want {
+			if plans[i].Segment != want[i].Segment || plans[i].Operation != want[i].Operation ||
+				!plans[i].At.Equal(want[i].At) || plans[i].Source != want[i].Source {
+				t.Errorf("got plan %v, want %v", plans[i], want[i])
+			}
+		}
+
+		f.expectSegments(t, u, "retro", "infect")
+		time.Sleep(time.Until(start.Add(750 * time.Millisecond)))
+		f.expectSegments(t, u, "a", "retro", "infect")
+		time.Sleep(time.Until(start.Add(1500 * time.Millisecond)))
+		f.expectSegments(t, u, "retro", "infect")
+		if plans, err = store.GetPlans(ctx, u); err != nil || len(plans) != 1 {
+			t.Errorf("got plans %v, %v, want one left", plans, err)
+		}
+	})
+
+	t.Run("Expiries", func(t *testing.T) {
+		// A removal with SourceTTL gives the segment its own TTL, overriding
+		// the one of the request.
+		u := f.user(20)
+		start := time.Now().Truncate(time.Millisecond)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("a"), f.name("b")}, nil, 3600,
+			Plan{Segment: f.name("a"), Operation: OpRemove, At: start.Add(500 * time.Millisecond), Source: SourceTTL}), nil)
+		f.expectSources(t, u, map[string]string{
+			"a": SourceTTL, "b": SourceTTL, "retro": SourceAutomatic, "infect": SourceAutomatic,
+		})
+		plans, err := store.GetPlans(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plans) != 2 || plans[0].Segment != f.name("a") || !plans[0].At.Equal(start.Add(500*time.Millisecond)) ||
+			plans[0].Source != SourceTTL || plans[1].Segment != f.name("b") {
+			t.Errorf("got plans %v, want a soon and b in an hour", plans)
+		}
+
+		time.Sleep(time.Until(start.Add(time.Second)))
+		f.expectSegments(t, u, "b", "retro", "infect")
+	})
+
+	t.Run("Removals", func(t *testing.T) {
+		u, other := f.user(21), f.user(22)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("a"), f.name("b")}, nil, 3600), nil)
+		expectErr(t, store.UpdateUser(ctx, other, []string{f.name("a")}, nil, 7200), nil)
+
+		removals := func() []Removal {
+			t.Helper()
+			var removals []Removal
+			err := store.ListRemovals(ctx, f.name("a"), RemovalFilter{}, func(removal Removal) error {
+				removals = append(removals, removal)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return removals
+		}
+		if got := removals(); len(got) != 2 || got[0].UserId != u || got[1].UserId != other || got[0].Source != SourceTTL {
+			t.Errorf("got removals %v, want of users %d and %d after TTL", got, u, other)
+		}
+		expectErr(t, store.ListRemovals(ctx, f.name("never existed"), RemovalFilter{}, nil), ErrNameFree)
+
+		// Pages go on after the last removal of the previous one.
+		var page []Removal
+		err := store.ListRemovals(ctx, f.name("a"), RemovalFilter{Limit: 1}, func(removal Removal) error {
+			page = append(page, removal)
+			return nil
+		})
+		expectErr(t, err, nil)
+		if len(page) != 1 || page[0].UserId != u {
+			t.Fatalf("got first page %v, want the removal of user %d", page, u)
+		}
+		after := page[0]
+		page = nil
+		err = store.ListRemovals(ctx, f.name("a"), RemovalFilter{After: &after, Limit: 1}, func(removal Removal) error {
+			page = append(page, removal)
+			return nil
+		})
+		expectErr(t, err, nil)
+		if len(page) != 1 || page[0].UserId != other {
+			t.Errorf("got second page %v, want the removal of user %d", page, other)
+		}
+
+		err = store.ExtendRemoval(ctx, u, f.name("infect"), time.Now())
+		expectErr(t, err, ErrNotPlanned)
+		expectBlame(t, err, "segment", f.name("infect"))
+		expectErr(t, store.CancelRemoval(ctx, u, f.name("never existed")), ErrNameFree)
+		expectErr(t, store.CancelRemoval(ctx, u, f.name("doomed")), ErrSegmentDeleted)
+
+		// Pushed back, user u is removed after the other user.
+		later := time.Now().Add(3 * time.Hour).Truncate(time.Millisecond)
+		expectErr(t, store.ExtendRemoval(ctx, u, f.name("a"), later), nil)
+		if got := removals(); len(got) != 2 || got[1].UserId != u || !got[1].At.Equal(later) {
+			t.Errorf("got removals %v, want user %d at %v last", got, u, later)
+		}
+
+		// Cancelled, the user stays for good.
+		expectErr(t, store.CancelRemoval(ctx, u, f.name("a")), nil)
+		expectErr(t, store.CancelRemoval(ctx, u, f.name("a")), ErrNotPlanned)
+		if got := removals(); len(got) != 1 || got[0].UserId != other {
+			t.Errorf("got removals %v, want only of user %d", got, other)
+		}
+		f.expectSources(t, u, map[string]string{
+			"a": SourceExplicit, "b": SourceTTL, "retro": SourceAutomatic, "infect": SourceAutomatic,
+		})
+
+		// Moved to the past, the removal is carried out right away.
+		expectErr(t, store.ExtendRemoval(ctx, u, f.name("b"), time.Now().Add(-time.Second)), nil)
+		time.Sleep(500 * time.Millisecond)
+		f.expectSegments(t, u, "a", "retro", "infect")
+	})
+
+	t.Run("NewTTL", func(t *testing.T) {
+		// The newest TTL wins, shorter or longer.
+		u := f.user(24)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("a")}, nil, 3600), nil)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("a")}, nil, 1), nil)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("b")}, nil, 1), nil)
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("b")}, nil, 3600), nil)
+
+		time.Sleep(1500 * time.Millisecond)
+		f.expectSegments(t, u, "b", "infect", "retro")
+
+		var at time.Time
+		err := store.ListRemovals(ctx, f.name("b"), RemovalFilter{}, func(removal Removal) error {
+			if removal.UserId == u {
+				at = removal.At
+			}
+			return nil
+		})
+		expectErr(t, err, nil)
+		if until := time.Until(at); until < 59*time.Minute || until > time.Hour {
+			t.Errorf("got removal at %v, want in an hour", at)
+		}
+	})
+
+	t.Run("AsOf", func(t *testing.T) {
+		u := f.user(23)
+		expectErr(t, store.CreateSegment(ctx, f.name("as of"), 0, "", SegmentMeta{}), nil)
+		expectErr(t, store.CreateSegment(ctx, f.name("as of/gone"), 0, "", SegmentMeta{}), nil)
+
+		// moment waits a bit, so that stamps before and after it differ.
+		moment := func() time.Time {
+			time.Sleep(20 * time.Millisecond)
+			defer time.Sleep(20 * time.Millisecond)
+			return time.Now()
+		}
+		before := moment()
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("as of"), f.name("as of/gone")}, nil, 0), nil)
+		joined := moment()
+		expectErr(t, store.UpdateUser(ctx, u, nil, []string{f.name("as of")}, 0), nil)
+		left := moment()
+		expectErr(t, store.DeleteSegment(ctx, f.name("as of/gone")), nil)
+		deleted := moment()
+		// Operations of one call share the stamp, the later one wins.
+		expectErr(t, store.UpdateUser(ctx, u, []string{f.name("as of")}, []string{f.name("as of")}, 0), nil)
+		both := moment()
+
+		for _, test := range []struct {
+			at   time.Time
+			want []string
+		}{
+			{before, nil},
+			{joined, []string{"as of", "as of/gone"}},
+			{left, []string{"as of/gone"}},
+			{deleted, nil},
+			{both, nil},
+		} {
+			all, err := store.GetSegmentsAsOf(ctx, u, test.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, name := range all {
+				if strings.HasPrefix(name, f.name("as of")) {
+					got = append(got, strings.TrimPrefix(name, f.prefix))
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("as of %v: got segments %q, want %q", test.at, got, test.want)
+			}
+		}
+
+		members := func(name string, at time.Time) []int {
+			t.Helper()
+			var users []int
+			err := store.ListMembers(ctx, f.name(name), MemberFilter{AsOf: &at}, func(userId int) error {
+				users = append(users, userId)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return users
+		}
+		if got := members("as of", joined); !reflect.DeepEqual(got, []int{u}) {
+			t.Errorf("got members %v as they joined, want %v", got, []int{u})
+		}
+		if got := members("as of", left); len(got) != 0 {
+			t.Errorf("got members %v as they left, want none", got)
+		}
+		if got := members("as of/gone", left); !reflect.DeepEqual(got, []int{u}) {
+			t.Errorf("got members %v before deletion, want %v", got, []int{u})
+		}
+		if got := members("as of/gone", deleted); len(got) != 0 {
+			t.Errorf("got members %v after deletion, want none", got)
+		}
+	})
+
+	t.Run("GetSegmentsBatch", func(t *testing.T) {
+		u, stranger := f.user(1), f.user(8)
+		batch, err := store.GetSegmentsBatch(ctx, []int{u, stranger, u})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) != 2 || batch[stranger] == nil || len(batch[stranger]) != 0 {
+			t.Errorf("got %q, want users %d and %d, the latter in no segments", batch, u, stranger)
+		}
+		single, err := store.GetSegments(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(single)
+		got := batch[u]
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, single) {
+			t.Errorf("got %q for user %d, want %q like GetSegments", got, u, single)
+		}
+
+		batch, err = store.GetSegmentsBatch(ctx, nil)
+		if err != nil || len(batch) != 0 {
+			t.Errorf("got %q, %v for no users", batch, err)
+		}
+	})
+
+	t.Run("UpdateUsers", func(t *testing.T) {
+		u, v := f.user(9), f.user(10)
+		input := fmt.Sprintf(`user_id,segment,op,ttl
+%[1]d,%[3]s,add
+%[1]d,%[4]s,add
+%[1]d,%[4]s,remove
+%[2]d,%[3]s,add
+%[2]d,%[5]s,add,3600
+%[1]d,%[6]s,add
+%[1]d,%[7]s,add
+x,%[3]s,add
+%[2]d,%[3]s,remove
+`, u, v, f.name("a"), f.name("b"), f.name("retro"), f.name("doomed"), f.name("never existed"))
+		rows, err := NewBulkReader(strings.NewReader(input), FormatCSV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := store.UpdateUsers(ctx, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Rows != 9 || result.Applied != 6 || result.Failed != 3 || len(result.Failures) != 3 {
+			t.Fatalf("got %+v", result)
+		}
+		for i, want := range []struct {
+			line    int
+			err     error
+			field   string
+			segment string
+		}{
+			{7, ErrSegmentDeleted, "segment", f.name("doomed")},
+			{8, ErrNameFree, "segment", f.name("never existed")},
+			{9, ErrBadRow, "user_id", f.name("a")},
+		} {
+			got := result.Failures[i]
+			if got.Line != want.line || !errors.Is(got.Err, want.err) || got.Err.Field != want.field || got.Err.Segment != want.segment {
+				t.Errorf("got failure %d %+v, want %+v", got.Line, got.Err, want)
+			}
+		}
+
+		// The last row for a user and segment wins, and users get into
+		// automatic segments like with UpdateUser.
+		f.expectSources(t, u, map[string]string{
+			"a": SourceExplicit, "retro": SourceAutomatic, "infect": SourceAutomatic,
+		})
+		f.expectSources(t, v, map[string]string{"retro": SourceTTL, "infect": SourceAutomatic})
+	})
+
+	t.Run("ListSegments", func(t *testing.T) {
+		expectErr(t, store.CreateSegment(ctx, f.name("list/1"), 0, "", SegmentMeta{}), nil)
+		expectErr(t, store.CreateSegment(ctx, f.name("list/2"), 0, "", SegmentMeta{}), nil)
+		expectErr(t, store.UpdateUser(ctx, f.user(5), []string{f.name("list/1")}, nil, 3600), nil)
+		expectErr(t, store.UpdateUser(ctx, f.user(6), []string{f.name("list/1")}, nil, 0), nil)
+		expectErr(t, store.DeleteSegment(ctx, f.name("list/2")), nil)
+
+		list := func(filter SegmentFilter) []SegmentInfo {
+			t.Helper()
+			filter.Prefix = f.name("list/")
+			segments, err := store.ListSegments(ctx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return segments
+		}
+
+		all := list(SegmentFilter{})
+		if len(all) != 2 {
+			t.Fatalf("got %+v, want list/1 and list/2", all)
+		}
+		active, deleted := all[0], all[1]
+		if active.Name != f.name("list/1") || active.Deleted || active.CreatedAt.IsZero() ||
+			active.Members != 2 || active.PendingRemovals != 1 {
+			t.Errorf("got %+v, want active list/1 with 2 members and 1 pending removal", active)
+		}
+		if deleted.Name != f.name("list/2") || !deleted.Deleted || deleted.DeletedAt.IsZero() ||
+			deleted.Members != 0 || deleted.Id <= active.Id {
+			t.Errorf("got %+v, want deleted list/2 after list/1", deleted)
+		}
+
+		no := false
+		if got := list(SegmentFilter{Deleted: &no}); len(got) != 1 || got[0].Id != active.Id {
+			t.Errorf("active only: got %+v", got)
+		}
+		if got := list(SegmentFilter{Limit: 1}); len(got) != 1 || got[0].Id != active.Id {
+			t.Errorf("first page: got %+v", got)
+		}
+		if got := list(SegmentFilter{After: active.Id, Limit: 1}); len(got) != 1 || got[0].Id != deleted.Id {
+			t.Errorf("second page: got %+v", got)
+		}
+
+		info, err := store.InspectSegment(ctx, f.name("list/2"))
+		if err != nil || info.Id != deleted.Id || !info.DeletedAt.Equal(deleted.DeletedAt) {
+			t.Errorf("got %+v, %v, want %+v", info, err, deleted)
+		}
+		_, err = store.InspectSegment(ctx, f.name("never existed"))
+		expectErr(t, err, ErrNameFree)
+	})
+
+	t.Run("ListMembers", func(t *testing.T) {
+		members := func(name string, filter MemberFilter) ([]int, error) {
+			var users []int
+			err := store.ListMembers(ctx, f.name(name), filter, func(userId int) error {
+				users = append(users, userId)
+				return nil
+			})
+			return users, err
+		}
+		expect := func(filter MemberFilter, want ...int) {
+			t.Helper()
+			got, err := members("list/1", filter)
+			if err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, %v, want %v", got, err, want)
+			}
+		}
+
+		expect(MemberFilter{}, f.user(5), f.user(6))
+		expect(MemberFilter{Limit: 1}, f.user(5))
+		after := f.user(5)
+		expect(MemberFilter{After: &after}, f.user(6))
+
+		if users, err := members("list/2", MemberFilter{}); err != nil || len(users) > 0 {
+			t.Errorf("deleted segment: got %v, %v, want no users", users, err)
+		}
+		_, err := members("never existed", MemberFilter{})
+		expectErr(t, err, ErrNameFree)
+
+		stop := errors.New("stop")
+		calls := 0
+		err = store.ListMembers(ctx, f.name("list/1"), MemberFilter{}, func(int) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Errorf("got %v after %d calls, want to stop after the first one", err, calls)
+		}
+	})
+
+	t.Run("Metadata", func(t *testing.T) {
+		meta := SegmentMeta{
+			Description: "For tests",
+			Owner:       "team",
+			Tags:        []string{"x", "y", "x"},
+			Attributes:  json.RawMessage(`{"b": 1, "a": [true]}`),
+		}
+		expectErr(t, store.CreateSegment(ctx, f.name("meta"), 0, "", meta), nil)
+		expectErr(t, store.CreateSegment(ctx, f.name("meta bad"), 0, "", SegmentMeta{Attributes: json.RawMessage(`[1]`)}), ErrBadAttributes)
+		expectErr(t, store.CreateSegment(ctx, f.name("meta bad"), 0, "", SegmentMeta{Tags: []string{""}}), ErrBadTag)
+
+		info, err := store.InspectSegment(ctx, f.name("meta"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Description != "For tests" || info.Owner != "team" ||
+			!reflect.DeepEqual(info.Tags, []string{"x", "y"}) || string(info.Attributes) != `{"a":[true],"b":1}` {
+			t.Errorf("got %+v", info.SegmentMeta)
+		}
+		if info, _ = store.InspectSegment(ctx, f.name("a")); len(info.Tags) != 0 || string(info.Attributes) != "{}" {
+			t.Errorf("got %+v, want no metadata", info.SegmentMeta)
+		}
+
+		tagged, err := store.ListSegments(ctx, SegmentFilter{Prefix: f.prefix, Tag: "y"})
+		if err != nil || len(tagged) != 1 || tagged[0].Name != f.name("meta") {
+			t.Errorf("got %+v, %v, want the segment tagged y", tagged, err)
+		}
+
+		description, owner, tags := "For tests", "other team", []string{"z"}
+		err = store.UpdateSegment(ctx, f.name("meta"), SegmentUpdate{Description: &description, Owner: &owner, Tags: &tags})
+		expectErr(t, err, nil)
+		// The same attributes written differently change nothing.
+		err = store.UpdateSegment(ctx, f.name("meta"), SegmentUpdate{Attributes: json.RawMessage(`{"a":[ true ],"b":1}`)})
+		expectErr(t, err, nil)
+		err = store.UpdateSegment(ctx, f.name("meta"), SegmentUpdate{Attributes: json.RawMessage(`"string"`)})
+		expectErr(t, err, ErrBadAttributes)
+		expectErr(t, store.UpdateSegment(ctx, f.name("never existed"), SegmentUpdate{Owner: &owner}), ErrNameFree)
+		expectErr(t, store.UpdateSegment(ctx, f.name("list/2"), SegmentUpdate{Owner: &owner}), ErrSegmentDeleted)
+
+		changes, err := store.SegmentChanges(ctx, f.name("meta"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, change := range changes {
+			got = append(got, fmt.Sprintf("%s %s %s", change.Field, change.Old, change.New))
+			if change.Stamp.IsZero() {
+				t.Errorf("change %+v has no stamp", change)
+			}
+		}
+		want := []string{`owner "team" "other team"`, `tags ["x","y"] ["z"]`}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got changes %q, want %q", got, want)
+		}
+
+		if changes, err = store.SegmentChanges(ctx, f.name("a")); err != nil || len(changes) != 0 {
+			t.Errorf("got %+v, %v, want no changes", changes, err)
+		}
+		_, err = store.SegmentChanges(ctx, f.name("never existed"))
+		expectErr(t, err, ErrNameFree)
+	})
+
+	t.Run("Ramp", func(t *testing.T) {
+		var users []int
+		for n := 10; n < 20; n++ {
+			users = append(users, f.user(n))
+		}
+		expectErr(t, store.CreateSegment(ctx, f.name("ramp base"), 0, "", SegmentMeta{}), nil)
+		expectErr(t, store.CreateSegment(ctx, f.name("ramp"), 0, "", SegmentMeta{}), nil)
+		for _, u := range users {
+			expectErr(t, store.UpdateUser(ctx, u, []string{f.name("ramp base")}, nil, 0), nil)
+		}
+		requested := users[0]
+		expectErr(t, store.UpdateUser(ctx, requested, []string{f.name("ramp")}, nil, 0), nil)
+
+		// members returns how many users are in the segment, including users
+		// of other tests, and fails if the requested one is not there.
+		members := func() int {
+			t.Helper()
+			in := map[int]bool{}
+			err := store.ListMembers(ctx, f.name("ramp"), MemberFilter{}, func(userId int) error {
+				in[userId] = true
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !in[requested] {
+				t.Errorf("user %d requested the segment, but is not there", requested)
+			}
+			return len(in)
+		}
+		setPercent := func(percent uint) error {
+			return store.UpdateSegment(ctx, f.name("ramp"), SegmentUpdate{Percent: &percent})
+		}
+
+		expectErr(t, setPercent(101), ErrBadPercent)
+		expectErr(t, setPercent(100), nil)
+		all := members()
+		for _, u := range users {
+			f.expectSegments(t, u, "ramp", "ramp base", "infect", "retro")
+		}
+
+		// A request makes an automatic membership requested.
+		requestedLater := users[1]
+		expectErr(t, store.UpdateUser(ctx, requestedLater, []string{f.name("ramp")}, nil, 0), nil)
+
+		expectErr(t, setPercent(50), nil)
+		// Automatic members are ranked, those ranked in the lower half stay.
+		if n := members(); n <= 2 || n >= all {
+			t.Errorf("at 50%%: %d of %d users are in", n, all)
+		}
+		expectErr(t, setPercent(0), nil)
+		if n := members(); n != 2 {
+			t.Errorf("at 0%%: %d users are in, want the 2 requested ones", n)
+		}
+		f.expectSegments(t, requestedLater, "ramp", "ramp base", "infect", "retro")
+
+		changes, err := store.SegmentChanges(ctx, f.name("ramp"))
+		if err != nil || len(changes) != 3 || changes[0].Field != "automatic_percent" ||
+			string(changes[0].Old) != "0" || string(changes[0].New) != "100" {
+			t.Errorf("got changes %+v, %v", changes, err)
+		}
+		info, err := store.InspectSegment(ctx, f.name("ramp"))
+		if err != nil || info.AutomaticPercent != 0 {
+			t.Errorf("got %+v, %v, want 0%%", info, err)
+		}
+	})
+
+	t.Run("Buckets", func(t *testing.T) {
+		salt := f.prefix
+		expectBuckets := func(percent uint, users ...int) {
+			t.Helper()
+			for _, u := range users {
+				in := false
+				for _, name := range f.segments(t, u) {
+					in = in || name == "bucket"
+				}
+				if want := inBucket(salt, percent, u); in != want {
+					t.Errorf("at %d%%: user %d with bucket %d is in: %v", percent, u, Bucket(salt, u), in)
+				}
+			}
+		}
+		var known []int
+		for n := 10; n < 20; n++ {
+			known = append(known, f.user(n))
+		}
+
+		expectErr(t, store.CreateSegment(ctx, f.name("bucket"), 30, salt, SegmentMeta{}), nil)
+		expectBuckets(30, known...)
+		for _, percent := range []uint{60, 10, 0, 100} {
+			expectErr(t, store.UpdateSegment(ctx, f.name("bucket"), SegmentUpdate{Percent: &percent}), nil)
+			expectBuckets(percent, known...)
+		}
+
+		percent := uint(50)
+		expectErr(t, store.UpdateSegment(ctx, f.name("bucket"), SegmentUpdate{Percent: &percent}), nil)
+		var unknown []int
+		for n := 30; n < 40; n++ {
+			unknown = append(unknown, f.user(n))
+			expectErr(t, store.UpdateUser(ctx, f.user(n), nil, nil, 0), nil)
+		}
+		expectBuckets(50, unknown...)
+
+		info, err := store.InspectSegment(ctx, f.name("bucket"))
+		if err != nil || info.Salt != salt {
+			t.Errorf("got %+v, %v, want salt %q", info, err, salt)
+		}
+	})
+
+	t.Run("GetHistory", func(t *testing.T) {
+		history := func(filter HistoryFilter) []HistoryRecord {
+			t.Helper()
+			var records []HistoryRecord
+			err := store.GetHistory(ctx, filter, func(record HistoryRecord) error {
+				records = append(records, record)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return records
+		}
+
+		now := time.Now().UTC()
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		records := history(HistoryFilter{From: month, To: month.AddDate(0, 1, 0)})
+		for i := 1; i < len(records); i++ {
+			if records[i].Stamp.Before(records[i-1].Stamp) {
+				t.Errorf("history is not in time order: %v before %v", records[i-1], records[i])
+				break
+			}
+		}
+		for _, want := range []HistoryRecord{
+			{UserId: f.user(1), Segment: f.name("a"), Operation: OpAdd, Source: SourceExplicit},
+			{UserId: f.user(1), Segment: f.name("b"), Operation: OpRemove, Source: SourceExplicit},
+			{UserId: f.user(2), Segment: f.name("retro"), Operation: OpAdd, Source: SourceAutomatic},
+			{UserId: f.user(4), Segment: f.name("b"), Operation: OpAdd, Source: SourceTTL},
+			{UserId: f.user(4), Segment: f.name("b"), Operation: OpRemove, Source: SourceTTL},
+			{UserId: f.user(11), Segment: f.name("a"), Operation: OpAdd, Source: SourceExplicit},
+			{UserId: f.user(11), Segment: f.name("a"), Operation: OpRemove, Source: SourceExplicit},
+			{UserId: f.user(19), Segment: f.name("ramp"), Operation: OpAdd, Source: SourceAutomatic},
+			{UserId: f.user(19), Segment: f.name("ramp"), Operation: OpRemove, Source: SourceAutomatic},
+		} {
+			found := false
+			for _, record := range records {
+				record.Stamp = time.Time{}
+				found = found || record == want
+			}
+			if !found {
+				t.Errorf("history lacks %+v", want)
+			}
+		}
+
+		january := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+		if records = history(HistoryFilter{From: january, To: january.AddDate(0, 1, 0)}); len(records) != 0 {
+			t.Errorf("history for January 2000 is not empty: %v", records)
+		}
+
+		// Filters combine.
+		u := f.user(11)
+		records = history(HistoryFilter{UserId: &u, Segment: f.name("a"), Operation: OpRemove})
+		if len(records) != 1 || records[0].UserId != u || records[0].Operation != OpRemove {
+			t.Errorf("got history %v, want one removal of user %d", records, u)
+		}
+		if records = history(HistoryFilter{UserId: &u, From: now.Add(time.Hour)}); len(records) != 0 {
+			t.Errorf("got history %v, want none in the future", records)
+		}
+
+		err := store.GetHistory(ctx, HistoryFilter{Segment: f.name("never existed")}, nil)
+		expectErr(t, err, ErrNameFree)
+		expectBlame(t, err, "segment", f.name("never existed"))
+
+		// Errors of fn stop the listing.
+		stop := errors.New("stop")
+		calls := 0
+		err = store.GetHistory(ctx, HistoryFilter{}, func(HistoryRecord) error {
+			calls++
+			return stop
+		})
+		if !errors.Is(err, stop) || calls != 1 {
+			t.Errorf("got %v after %d calls, want the error of fn after one", err, calls)
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	defer store.Close()
+	testConformance(t, store)
+
+	// Deferred cleanup closes it once more.
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openPostgres opens the store configured like the server, or skips the test
+// unless TEST_BACKEND=postgres.
+func openPostgres(t *testing.T) *Store {
+	t.Helper()
+	if os.Getenv("TEST_BACKEND") != "postgres" {
+		t.Skip("set TEST_BACKEND=postgres to run")
+	}
+	cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(context.Background(), cfg.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestPostgresStore(t *testing.T) {
+	store := openPostgres(t)
+	testConformance(t, store)
+
+	// Cleanup closes it once more.
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Adding a user to a segment they are in used to fail on the unique
+// constraint of users_to_segments with an internal error.
+func TestPostgresAddTwice(t *testing.T) {
+	var (
+		store  = openPostgres(t)
+		ctx    = context.Background()
+		name   = fmt.Sprintf("add twice %d", time.Now().UnixNano())
+		userId = 1_000_000 + rand.Intn(1_000_000_000)
+	)
+	if err := store.CreateSegment(ctx, name, 0, "", SegmentMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.UpdateUser(ctx, userId, []string{name}, nil, 0); err != nil {
+			t.Fatalf("adding for the %d. time: %v", i+1, err)
+		}
+	}
+
+	var additions int
+	err := store.db.QueryRowContext(ctx, `
+select count(*)
+from operation_history
+join segments on segments.id = segment_id
+where segments.name = $1 and user_id = $2 and operation = 'add';
+`, name, userId).Scan(&additions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if additions != 1 {
+		t.Errorf("got %d additions in the history, want 1", additions)
+	}
+}
+
+// The known user ranked last by percent_rank has the rank of exactly 1, so a
+// 100% segment used to get every known user but one.
+func TestPostgresFullSegment(t *testing.T) {
+	var (
+		store = openPostgres(t)
+		ctx   = context.Background()
+		name  = fmt.Sprintf("full %d", time.Now().UnixNano())
+	)
+	// At least two known users, so that someone is ranked last.
+	if err := store.CreateSegment(ctx, name+" seed", 0, "", SegmentMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	defer store.DeleteSegment(ctx, name+" seed")
+	for i := 0; i < 2; i++ {
+		userId := 1_000_000 + rand.Intn(1_000_000_000)
+		if err := store.UpdateUser(ctx, userId, []string{name + " seed"}, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.CreateSegment(ctx, name, 100, "", SegmentMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	// 100% segments would leak into other tests.
+	defer store.DeleteSegment(ctx, name)
+
+	var left int
+	err := store.db.QueryRowContext(ctx, `
+select count(distinct user_id)
+from users_to_segments uts
+where not exists (
+   select from users_to_segments
+   join segments on segments.id = segment_id
+   where segments.name = $1 and user_id = uts.user_id
+);
+`, name).Scan(&left)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Errorf("%d known users are not in a 100%% segment", left)
+	}
+}
@@ -5,4 +5,5 @@ go 1.19
 require (
 	github.com/gorilla/mux v1.8.0
 	github.com/lib/pq v1.10.9
+	gopkg.in/yaml.v3 v3.0.1
 )
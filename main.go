@@ -1,15 +1,208 @@
 package main
 
 import (
+	"avito2023/config"
 	"avito2023/db"
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
 
 	"avito2023/web"
 )
 
+func usage() {
+	out := flag.CommandLine.Output()
+	_, _ = fmt.Fprintf(out, `Usage: %s [flags] [command]
+
+Commands:
+  serve              Run the HTTP server. The default.
+  migrate up         Apply all pending migrations.
+  migrate down [N]   Revert N latest migrations, 1 by default.
+  migrate status     List migrations.
+  import [-format csv|ndjson] [FILE]
+                     Add users to segments and remove them in bulk. Reads
+                     FILE or standard input, see README.md for the format.
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
 func main() {
-	defer db.Close()
-	log.Println("Server started")
-	log.Fatal(http.ListenAndServe(":8080", web.NewRouter()))
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to the YAML configuration file")
+	flag.Usage = usage
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch args := flag.Args(); {
+	case len(args) == 0 || args[0] == "serve":
+		err = serve(cfg)
+	case args[0] == "migrate":
+		err = migrate(cfg, args[1:])
+	case args[0] == "import":
+		err = importRows(cfg, args[1:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// serve runs the server until SIGINT or SIGTERM. Then it stops accepting
+// connections, waits for in-flight requests, stops the schedule and only then
+// closes the database.
+func serve(cfg config.Config) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	store, err := db.Open(ctx, cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := store.Close(); err != nil {
+			log.Println(err)
+		}
+		log.Println("Server stopped")
+	}()
+
+	server := &http.Server{
+		Addr:    cfg.Listen,
+		Handler: web.NewRouter(store),
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	log.Println("Server started on", cfg.Listen)
+
+	select {
+	case err = <-serverErr:
+		return err
+	case <-ctx.Done():
+		stop() // A second signal kills the process right away.
+	}
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		log.Println("Could not wait for all requests:", err)
+	}
+	return nil
+}
+
+func migrate(cfg config.Config, args []string) error {
+	ctx := context.Background()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "up":
+		return db.MigrateUp(ctx, cfg.Database)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("bad number of migrations: %s", args[1])
+			}
+			steps = n
+		}
+		return db.MigrateDown(ctx, cfg.Database, steps)
+	case "status":
+		statuses, err := db.MigrationStatuses(ctx, cfg.Database)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, state)
+		}
+		return nil
+	default:
+		usage()
+		os.Exit(2)
+	}
+	return nil
+}
+
+// importRows applies a bulk update from a file and reports failed rows.
+func importRows(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	format := flags.String("format", "", "csv or ndjson, by default guessed by the file extension")
+	_ = flags.Parse(args)
+
+	var (
+		in   io.Reader = os.Stdin
+		path           = flags.Arg(0)
+	)
+	if path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	if *format == "" {
+		switch filepath.Ext(path) {
+		case ".ndjson", ".jsonl":
+			*format = db.FormatNDJSON
+		default:
+			*format = db.FormatCSV
+		}
+	}
+
+	rows, err := db.NewBulkReader(bufio.NewReaderSize(in, 1<<20), *format)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	store, err := db.Open(ctx, cfg.Database)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	result, err := store.UpdateUsers(ctx, rows)
+	if err != nil {
+		return err
+	}
+	for _, failure := range result.Failures {
+		fmt.Printf("line %d: %s", failure.Line, failure.Err.Message)
+		if failure.Err.Field != "" {
+			fmt.Printf(", field %s", failure.Err.Field)
+		}
+		if failure.Err.Segment != "" {
+			fmt.Printf(", segment %q", failure.Err.Segment)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("Read %d rows, applied %d, failed %d\n", result.Rows, result.Applied, result.Failed)
+	if result.Failed > 0 {
+		return fmt.Errorf("%d rows failed", result.Failed)
+	}
+	return nil
 }
@@ -1,20 +1,30 @@
 package main
 
 import (
+	"avito2023/config"
+	"avito2023/db"
 	"avito2023/web"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 )
 
-const host = "http://localhost:8080/"
+// Set in TestMain.
+var host string
 
 var client = &http.Client{}
 
@@ -54,7 +64,7 @@ type TestCreate struct {
 func (tc *TestCreate) Test(idx int, t *testing.T) {
 	response, ok := yesbut("create_segment", tc.CreateSegmentBody, tc.ResponseUsual)
 	if !ok {
-		t.Errorf("Failed test %d: got %q instead of %q", idx, response, tc.ResponseUsual)
+		t.Errorf("Failed test %d: got %+v instead of %+v", idx, response, tc.ResponseUsual)
 	}
 }
 
@@ -66,7 +76,7 @@ type TestDelete struct {
 func (tc *TestDelete) Test(idx int, t *testing.T) {
 	response, ok := yesbut("delete_segment", tc.DeleteSegmentBody, tc.ResponseUsual)
 	if !ok {
-		t.Errorf("Failed test %d: got %q instead of %q", idx, response, tc.ResponseUsual)
+		t.Errorf("Failed test %d: got %+v instead of %+v", idx, response, tc.ResponseUsual)
 	}
 }
 
@@ -78,7 +88,7 @@ type TestUpdate struct {
 func (tc *TestUpdate) Test(idx int, t *testing.T) {
 	response, ok := yesbut("update_user", tc.UpdateUserBody, tc.ResponseUsual)
 	if !ok {
-		t.Errorf("Failed test %d: got %q instead of %q", idx, response, tc.ResponseUsual)
+		t.Errorf("Failed test %d: got %+v instead of %+v", idx, response, tc.ResponseUsual)
 	}
 }
 
@@ -94,7 +104,7 @@ func (tc *TestGet) Test(idx int, t *testing.T) {
 	ok1 := reflect.DeepEqual(response, tc.possibility1)
 	ok2 := reflect.DeepEqual(response, tc.possibility2)
 	if !(ok1 || ok2) {
-		t.Errorf("Failed test %d: got %q instead of %q or %q", idx, response, tc.possibility1, tc.possibility2)
+		t.Errorf("Failed test %d: got %+v instead of %+v or %+v", idx, response, tc.possibility1, tc.possibility2)
 	}
 }
 
@@ -106,7 +116,7 @@ type TestHistory struct {
 func (tc *TestHistory) Test(idx int, t *testing.T) {
 	response, ok := yesbut("history", tc.HistoryBody, tc.ResponseHistory)
 	if !ok {
-		t.Errorf("Failed test %d: got %q instead of %q", idx, response, tc.ResponseHistory)
+		t.Errorf("Failed test %d: got %+v instead of %+v", idx, response, tc.ResponseHistory)
 	}
 }
 
@@ -129,7 +139,7 @@ func TestCreateSegment(t *testing.T) {
 		},
 		&TestCreate{
 			web.CreateSegmentBody{Name: "segment 1"},
-			web.ResponseUsual{Status: "error", Err: "name taken"},
+			web.ResponseUsual{Status: "error", Err: "name taken", ErrorDetails: web.ErrorDetails{Code: "name_taken", Field: "name", Segment: "segment 1"}},
 		},
 		&TestCreate{
 			web.CreateSegmentBody{Name: "segment to delete 1"},
@@ -137,7 +147,7 @@ func TestCreateSegment(t *testing.T) {
 		},
 		&TestCreate{
 			web.CreateSegmentBody{Name: "quarnishone", Percent: 123},
-			web.ResponseUsual{Status: "error", Err: "bad percent"},
+			web.ResponseUsual{Status: "error", Err: "bad percent", ErrorDetails: web.ErrorDetails{Code: "bad_percent", Field: "percent", Segment: "quarnishone"}},
 		},
 		&TestCreate{
 			web.CreateSegmentBody{Name: "fifty-fifty", Percent: 50}, // !
@@ -149,7 +159,7 @@ func TestCreateSegment(t *testing.T) {
 		},
 		&TestCreate{
 			web.CreateSegmentBody{Name: ""},
-			web.ResponseUsual{Status: "error", Err: "name empty"},
+			web.ResponseUsual{Status: "error", Err: "name empty", ErrorDetails: web.ErrorDetails{Code: "name_empty", Field: "name"}},
 		},
 	} {
 		test.Test(i+1, t)
@@ -164,11 +174,11 @@ func TestDeleteSegment(t *testing.T) {
 		},
 		&TestDelete{
 			web.DeleteSegmentBody{Name: "segment to delete 1"},
-			web.ResponseUsual{Status: "error", Err: "segment deleted"},
+			web.ResponseUsual{Status: "error", Err: "segment deleted", ErrorDetails: web.ErrorDetails{Code: "segment_deleted", Field: "name", Segment: "segment to delete 1"}},
 		},
 		&TestDelete{
 			web.DeleteSegmentBody{Name: "quasimodo"},
-			web.ResponseUsual{Status: "error", Err: "name free"},
+			web.ResponseUsual{Status: "error", Err: "name free", ErrorDetails: web.ErrorDetails{Code: "name_free", Field: "name", Segment: "quasimodo"}},
 		},
 	} {
 		test.Test(i+1, t)
@@ -178,20 +188,20 @@ func TestDeleteSegment(t *testing.T) {
 func TestUpdateUser(t *testing.T) {
 	for i, test := range []Testable{
 		&TestUpdate{
-			web.UpdateUserBody{Id: 546, AddToSegments: []string{"segment to delete 1"}},
-			web.ResponseUsual{Status: "error", Err: "segment deleted"},
+			web.UpdateUserBody{Id: 546, AddToSegments: []web.SegmentAddition{{Name: "segment to delete 1"}}},
+			web.ResponseUsual{Status: "error", Err: "segment deleted", ErrorDetails: web.ErrorDetails{Code: "segment_deleted", Field: "add_to_segments", Segment: "segment to delete 1"}},
 		},
 		&TestUpdate{
-			web.UpdateUserBody{Id: 101, AddToSegments: []string{"segment 1", "segment 2"}, RemoveFromSegments: []string{}},
+			web.UpdateUserBody{Id: 101, AddToSegments: []web.SegmentAddition{{Name: "segment 1"}, {Name: "segment 2"}}, RemoveFromSegments: []string{}},
 			web.ResponseUsual{Status: "ok"},
 		},
 		&TestUpdate{
-			web.UpdateUserBody{Id: 101, AddToSegments: []string{}, RemoveFromSegments: []string{"segment 2"}},
+			web.UpdateUserBody{Id: 101, AddToSegments: []web.SegmentAddition{}, RemoveFromSegments: []string{"segment 2"}},
 			web.ResponseUsual{Status: "ok"},
 		},
 		&TestUpdate{
 			// This shall perish in a second
-			web.UpdateUserBody{Id: 1234, AddToSegments: []string{"segment 1"}, Ttl: 1},
+			web.UpdateUserBody{Id: 1234, AddToSegments: []web.SegmentAddition{{Name: "segment 1"}}, Ttl: 1},
 			web.ResponseUsual{Status: "ok"},
 		},
 		&TestGet{
@@ -201,7 +211,7 @@ func TestUpdateUser(t *testing.T) {
 		},
 		&TestUpdate{
 			// This shall perish in a second
-			web.UpdateUserBody{Id: 12345, AddToSegments: []string{"segment 1", "segment 2"}, Ttl: 1},
+			web.UpdateUserBody{Id: 12345, AddToSegments: []web.SegmentAddition{{Name: "segment 1"}, {Name: "segment 2"}}, Ttl: 1},
 			web.ResponseUsual{Status: "ok"},
 		},
 	} {
@@ -240,19 +250,23 @@ func TestGetSegments(t *testing.T) {
 func TestHistoryPost(t *testing.T) {
 	for i, test := range []Testable{
 		&TestHistory{
-			web.HistoryBody{1000, 1},
-			web.ResponseHistory{Status: "error", Err: "bad time"},
+			web.HistoryBody{}, // Neither a month nor from.
+			web.ResponseHistory{Status: "error", Err: "bad time", ErrorDetails: web.ErrorDetails{Code: "bad_time"}},
 		},
 		&TestHistory{
-			web.HistoryBody{2024, 13},
-			web.ResponseHistory{Status: "error", Err: "bad time"},
+			web.HistoryBody{Year: 1000, Month: 1},
+			web.ResponseHistory{Status: "error", Err: "bad time", ErrorDetails: web.ErrorDetails{Code: "bad_time"}},
 		},
 		&TestHistory{
-			web.HistoryBody{2023, 6},
+			web.HistoryBody{Year: 2024, Month: 13},
+			web.ResponseHistory{Status: "error", Err: "bad time", ErrorDetails: web.ErrorDetails{Code: "bad_time"}},
+		},
+		&TestHistory{
+			web.HistoryBody{Year: 2023, Month: 6},
 			web.ResponseHistory{Status: "ok", Link: "/history?year=2023&month=6"},
 		},
 		&TestHistory{
-			web.HistoryBody{2023, 10},
+			web.HistoryBody{Year: 2023, Month: 10},
 			web.ResponseHistory{Status: "ok", Link: "/history?year=2023&month=10"},
 		},
 	} {
@@ -295,8 +309,1020 @@ func TestHistoryGet(t *testing.T) {
 	}
 }
 
+func TestHistoryFilters(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "history/a"})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{Id: 7800, AddToSegments: []web.SegmentAddition{{Name: "history/a"}}})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{Id: 7800, RemoveFromSegments: []string{"history/a"}})
+
+	var (
+		userId = int32(7800)
+		from   = time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	)
+	response := post[web.ResponseHistory]("history", web.HistoryBody{
+		From: &from, UserId: &userId, Segment: "history/a", Operation: "remove", Timezone: "Europe/Moscow",
+	})
+	want := "/history?from=2023-09-01T00%3A00%3A00Z&user_id=7800&segment=history%2Fa&operation=remove&timezone=Europe%2FMoscow"
+	if response.Status != "ok" || response.Link != want {
+		t.Errorf("Got %+v, want link %s", response, want)
+	}
+	response = post[web.ResponseHistory]("history", web.HistoryBody{Year: 2023, Month: 9, From: &from})
+	if response.Status != "error" || response.Code != "bad_request" || response.Field != "from" {
+		t.Errorf("Got %+v", response)
+	}
+
+	for i, test := range []struct {
+		query  string
+		status int
+		lines  []string
+	}{
+		{"user_id=7800&segment=history%2Fa&from=2023-09-01T00:00:00Z", 200, []string{"7800;history/a;add;", "7800;history/a;remove;"}},
+		{"user_id=7800&segment=history%2Fa&operation=remove&timezone=Europe%2FMoscow&from=2023-09-01T00:00:00Z", 200, []string{"7800;history/a;remove;"}},
+		{"user_id=7800&segment=history%2Fa&from=2023-09-01T00:00:00Z&to=2023-10-01T00:00:00Z", 200, nil},
+		{"from=2023-10-01T00:00:00Z&to=2023-09-01T00:00:00Z", 404, nil},
+		{"segment=history%2Fnone&from=2023-09-01T00:00:00Z", 404, nil},
+		{"user_id=7800&segment=history%2Fa", 404, nil},
+		{"to=2023-10-01T00:00:00Z", 404, nil},
+		{"timezone=Mars%2FOlympus", 400, nil},
+		{"operation=rename&from=2023-09-01T00:00:00Z", 400, nil},
+	} {
+		status, body := request("GET", "history?"+test.query, nil)
+		if status != test.status {
+			t.Errorf("%d. %s: got %d %s, want %d", i, test.query, status, body, test.status)
+			continue
+		}
+		if status != 200 {
+			continue
+		}
+		var lines []string
+		if body != "" {
+			lines = strings.Split(body, "\n")
+		}
+		if len(lines) != len(test.lines) {
+			t.Errorf("%d. %s: got %q, want %q", i, test.query, lines, test.lines)
+			continue
+		}
+		for j, line := range lines {
+			if !strings.HasPrefix(line, test.lines[j]) {
+				t.Errorf("%d. %s: got line %q, want %q", i, test.query, line, test.lines[j])
+			}
+		}
+		if strings.Contains(test.query, "Moscow") && !strings.Contains(body, "+0300 MSK") {
+			t.Errorf("%d. %s: got %s, want Moscow time", i, test.query, body)
+		}
+	}
+
+	post[web.ResponseUsual]("delete_segment", web.DeleteSegmentBody{Name: "history/a"})
+}
+
+func TestHistoryExport(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "history/b"})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{Id: 7801, AddToSegments: []web.SegmentAddition{{Name: "history/b"}}})
+	defer post[web.ResponseUsual]("delete_segment", web.DeleteSegmentBody{Name: "history/b"})
+
+	now := time.Now().UTC()
+	for _, encoding := range []string{"gzip", "identity"} {
+		path := fmt.Sprintf("history?year=%d&month=%d&user_id=7801&segment=history%%2Fb", now.Year(), now.Month())
+		req, err := http.NewRequest("GET", host+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Set by hand, the client does not decompress.
+		req.Header.Set("Accept-Encoding", encoding)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		wantName := fmt.Sprintf(`attachment; filename=history-%04d-%02d-user-7801.csv`, now.Year(), now.Month())
+		if got := resp.Header.Get("Content-Disposition"); got != wantName {
+			t.Errorf("%s: got Content-Disposition %q, want %q", encoding, got, wantName)
+		}
+		var body io.Reader = resp.Body
+		if encoding == "gzip" {
+			if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("got Content-Encoding %q, want gzip", got)
+			}
+			if body, err = gzip.NewReader(resp.Body); err != nil {
+				t.Fatal(err)
+			}
+		} else if got := resp.Header.Get("Content-Encoding"); got != "" {
+			t.Errorf("got Content-Encoding %q, want none", got)
+		}
+		b, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(b), "7801;history/b;add;") || strings.Count(string(b), "\n") != 1 {
+			t.Errorf("%s: got %q, want one addition", encoding, b)
+		}
+	}
+}
+
+func TestHistoryFormats(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "history/c"})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{Id: 7802, AddToSegments: []web.SegmentAddition{{Name: "history/c"}}})
+	defer post[web.ResponseUsual]("delete_segment", web.DeleteSegmentBody{Name: "history/c"})
+
+	var (
+		userId = int32(7802)
+		from   = time.Date(2023, 9, 1, 0, 0, 0, 0, time.UTC)
+	)
+	response := post[web.ResponseHistory]("history", web.HistoryBody{
+		From: &from, UserId: &userId, Segment: "history/c", Format: "tsv", Columns: []string{"stamp", "user_id"},
+	})
+	want := "/history?from=2023-09-01T00%3A00%3A00Z&user_id=7802&segment=history%2Fc&format=tsv&columns=stamp%2Cuser_id"
+	if response.Status != "ok" || response.Link != want {
+		t.Errorf("Got %+v, want link %s", response, want)
+	}
+
+	const filter = "history?from=2023-09-01T00:00:00Z&user_id=7802&segment=history%2Fc&timezone=Europe%2FMoscow&"
+	status, body := request("GET", filter+"format=csv", nil)
+	lines := strings.Split(body, "\n")
+	if status != 200 || len(lines) != 2 || lines[0] != "user_id,segment,operation,stamp,source" {
+		t.Fatalf("csv: got %d %q", status, body)
+	}
+	fields := strings.Split(lines[1], ",")
+	if len(fields) != 5 || fields[0] != "7802" || fields[1] != "history/c" || fields[4] != "explicit" {
+		t.Errorf("csv: got %q", lines[1])
+	}
+	if _, err := time.Parse(time.RFC3339, fields[3]); err != nil || !strings.HasSuffix(fields[3], "+03:00") {
+		t.Errorf("csv: got stamp %q, want RFC 3339 in Moscow time", fields[3])
+	}
+
+	status, body = request("GET", filter+"format=tsv&columns=stamp,user_id", nil)
+	if lines = strings.Split(body, "\n"); status != 200 || len(lines) != 2 || lines[0] != "stamp\tuser_id" ||
+		!strings.HasSuffix(lines[1], "+03:00\t7802") {
+		t.Errorf("tsv: got %d %q", status, body)
+	}
+
+	type record struct {
+		UserId    int       `json:"user_id"`
+		Segment   string    `json:"segment"`
+		Operation string    `json:"operation"`
+		Stamp     time.Time `json:"stamp"`
+		Source    string    `json:"source"`
+	}
+	var one record
+	status, body = request("GET", filter+"format=ndjson", nil)
+	if err := json.Unmarshal([]byte(body), &one); err != nil || status != 200 ||
+		one.UserId != 7802 || one.Operation != "add" || one.Stamp.IsZero() {
+		t.Errorf("ndjson: got %d %q", status, body)
+	}
+	var all []map[string]any
+	status, body = request("GET", filter+"format=json&columns=segment", nil)
+	if err := json.Unmarshal([]byte(body), &all); err != nil || status != 200 ||
+		!reflect.DeepEqual(all, []map[string]any{{"segment": "history/c"}}) {
+		t.Errorf("json: got %d %q", status, body)
+	}
+	status, body = request("GET", "history?from=2023-09-01T00:00:00Z&segment=history%2Fc&user_id=1&format=json", nil)
+	if status != 200 || body != "[]" {
+		t.Errorf("empty json: got %d %q", status, body)
+	}
+
+	resp, err := client.Get(host + filter + "format=parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Header.Get("Content-Type") != "application/vnd.apache.parquet" ||
+		!bytes.HasPrefix(b, []byte("PAR1")) || !bytes.HasSuffix(b, []byte("PAR1")) {
+		t.Errorf("parquet: got %s %q", resp.Header.Get("Content-Type"), b)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != "attachment; filename=history-user-7802.parquet" {
+		t.Errorf("parquet: got Content-Disposition %q", got)
+	}
+
+	for _, query := range []string{"format=xlsx", "columns=user_id,password", "columns=stamp,stamp"} {
+		if status, body = request("GET", filter+query, nil); status != 400 {
+			t.Errorf("%s: got %d %s, want 400", query, status, body)
+		}
+	}
+}
+
+// failingStore is a store whose history and members have rows and then fail.
+type failingStore struct {
+	db.SegmentStore
+	rows int
+}
+
+var errFailing = errors.New("connection reset by peer")
+
+func (s failingStore) GetHistory(_ context.Context, _ db.HistoryFilter, fn func(record db.HistoryRecord) error) error {
+	record := db.HistoryRecord{UserId: 1, Segment: "history/d", Operation: db.OpAdd, Stamp: time.Now(), Source: "explicit"}
+	for i := 0; i < s.rows; i++ {
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return errFailing
+}
+
+func (s failingStore) ListMembers(_ context.Context, _ string, _ db.MemberFilter, fn func(userId int) error) error {
+	for userId := 1; userId <= s.rows; userId++ {
+		if err := fn(userId); err != nil {
+			return err
+		}
+	}
+	return errFailing
+}
+
+// getFailing requests the path from a server with a failing store. It returns
+// the status and the body together with the error of reading it.
+func getFailing(t *testing.T, rows int, path string) (int, []byte, error) {
+	t.Helper()
+	server := httptest.NewServer(web.NewRouter(failingStore{rows: rows}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A gzip stream that never ends breaks anyway, a plain body must too.
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, b, err
+}
+
+// testStreamFails checks that a stream failing before the first row gets an
+// error status, and one failing after it does not look complete.
+func testStreamFails(t *testing.T, path string) {
+	t.Helper()
+	// Nothing is sent yet, so the error is reported properly.
+	if status, b, err := getFailing(t, 0, path); status != 500 || err != nil {
+		t.Errorf("%s: got %d %q, %v, want 500", path, status, b, err)
+	}
+	// Some rows are sent, but the body must not end cleanly.
+	status, b, err := getFailing(t, 5000, path)
+	if status != 200 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("%s: got %d, %d bytes, %v, want 200 and a broken body", path, status, len(b), err)
+	}
+	if len(b) == 0 {
+		t.Errorf("%s: got no rows before the failure", path)
+	}
+}
+
+func TestHistoryFails(t *testing.T) {
+	testStreamFails(t, "/history?from=2023-09-01T00:00:00Z")
+
+	// Only internal errors have ids.
+	server := httptest.NewServer(web.NewRouter(failingStore{}))
+	defer server.Close()
+	for _, test := range []struct {
+		host, path string
+		status     int
+		id         bool
+	}{
+		{server.URL + "/", "history?from=2023-09-01T00:00:00Z", 500, true},
+		{host, "history?from=2023-09-01T00:00:00Z&segment=history%2Fnone", 404, false},
+	} {
+		resp, err := client.Get(test.host + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		ids := resp.Header.Values("X-Error-Id")
+		hasId := len(ids) == 1 && ids[0] != ""
+		if resp.StatusCode != test.status || hasId != test.id || (!test.id && len(ids) != 0) {
+			t.Errorf("%s: got %d with X-Error-Id %q, want %d and an id: %v", test.path, resp.StatusCode, ids, test.status, test.id)
+		}
+	}
+}
+
+func TestSegmentUsersFails(t *testing.T) {
+	for _, format := range []string{"csv", "ndjson"} {
+		testStreamFails(t, "/segments/users%2Ffailing/users?format="+format)
+	}
+}
+
+// The tests run against an in-memory store, or against Postgres configured
+// like the server if TEST_BACKEND=postgres. The Postgres database must be
+// fresh, see docker-compose-testing.yml.
 func TestMain(m *testing.M) {
-	go main()
-	time.Sleep(200 * time.Millisecond) // Plenty of time for main() to start.
-	os.Exit(m.Run())
+	var store db.SegmentStore = db.NewMemoryStore()
+	if os.Getenv("TEST_BACKEND") == "postgres" {
+		cfg, err := config.Load(os.Getenv("CONFIG_FILE"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		pgStore, err := db.Open(context.Background(), cfg.Database)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = pgStore
+	}
+
+	server := httptest.NewServer(web.NewRouter(store))
+	host = server.URL + "/"
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+// request makes a request to the v2 API and returns the status code and the
+// body of the response.
+func request(method, path string, payload any) (int, string) {
+	var body io.Reader = http.NoBody
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			panic(err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, host+path, body)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestV2(t *testing.T) {
+	for i, test := range []struct {
+		method, path string
+		payload      any
+		status       int
+		body         string
+	}{
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "v2/one"}, 201, ""},
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "v2 two", Percent: 0}, 201, ""},
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "v2/one"}, 409, `{"error":"name taken","code":"name_taken","field":"name","segment":"v2/one"}`},
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: ""}, 422, `{"error":"name empty","code":"name_empty","field":"name"}`},
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "v2 bad", Percent: 101}, 422, `{"error":"bad percent","code":"bad_percent","field":"percent","segment":"v2 bad"}`},
+		{"POST", "v2/segments", "not an object", 400, ""},
+		{"POST", "v2/segments", map[string]any{"name": 1}, 400, ""},
+
+		{"PATCH", "v2/users/2000/segments", web.UpdateUserSegmentsBody{AddToSegments: []web.SegmentAddition{{Name: "v2/one"}, {Name: "v2 two"}}}, 204, ""},
+		{"PATCH", "v2/users/2000/segments", web.UpdateUserSegmentsBody{RemoveFromSegments: []string{"v2 two"}}, 204, ""},
+		{"PATCH", "v2/users/2000/segments", web.UpdateUserSegmentsBody{AddToSegments: []web.SegmentAddition{{Name: "v2 none"}}}, 404, `{"error":"name free","code":"name_free","field":"add_to_segments","segment":"v2 none"}`},
+		{"PATCH", "v2/users/abc/segments", web.UpdateUserSegmentsBody{}, 400, `{"error":"bad user id","code":"bad_request","field":"id"}`},
+
+		{"DELETE", "v2/segments/v2%2Fone", nil, 204, ""},
+		{"DELETE", "v2/segments/v2%2Fone", nil, 409, `{"error":"segment deleted","code":"segment_deleted","field":"name","segment":"v2/one"}`},
+		{"DELETE", "v2/segments/v2%20none", nil, 404, `{"error":"name free","code":"name_free","field":"name","segment":"v2 none"}`},
+		{"PATCH", "v2/users/2000/segments", web.UpdateUserSegmentsBody{AddToSegments: []web.SegmentAddition{{Name: "v2/one"}}}, 409, `{"error":"segment deleted","code":"segment_deleted","field":"add_to_segments","segment":"v2/one"}`},
+
+		{"GET", "v2/users/2001/segments", nil, 200, `{"segments":[]}`},
+	} {
+		status, body := request(test.method, test.path, test.payload)
+		if status != test.status || (test.body != "" && body != test.body) {
+			t.Errorf("Failed test %d: got %d %s instead of %d %s", i+1, status, body, test.status, test.body)
+		}
+	}
+
+	// Automatic segments from other tests might be there too.
+	status, body := request("GET", "v2/users/2000/segments", nil)
+	var segments web.ResponseUserSegments
+	if err := json.Unmarshal([]byte(body), &segments); status != 200 || err != nil {
+		t.Fatalf("Failed to get segments: %d %s", status, body)
+	}
+	for _, name := range segments.Segments {
+		if strings.HasPrefix(name, "v2") {
+			t.Errorf("User 2000 is still in %q", name)
+		}
+	}
+}
+
+func TestSegmentList(t *testing.T) {
+	for _, test := range []struct {
+		method, path string
+		payload      any
+		status       int
+	}{
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "listed/a"}, 201},
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "listed/b"}, 201},
+		{"PATCH", "v2/users/3000/segments", web.UpdateUserSegmentsBody{AddToSegments: []web.SegmentAddition{{Name: "listed/a"}}}, 204},
+		{"DELETE", "v2/segments/listed%2Fb", nil, 204},
+	} {
+		if status, body := request(test.method, test.path, test.payload); status != test.status {
+			t.Fatalf("%s %s: got %d %s", test.method, test.path, status, body)
+		}
+	}
+
+	list := func(path string) web.ResponseSegmentList {
+		t.Helper()
+		status, body := request("GET", path, nil)
+		var list web.ResponseSegmentList
+		if err := json.Unmarshal([]byte(body), &list); status != 200 || err != nil {
+			t.Fatalf("GET %s: got %d %s", path, status, body)
+		}
+		return list
+	}
+
+	all := list("segments?prefix=listed%2F")
+	if len(all.Segments) != 2 || all.NextAfter != 0 {
+		t.Fatalf("Got %+v, want listed/a and listed/b", all)
+	}
+	a, b := all.Segments[0], all.Segments[1]
+	if a.Name != "listed/a" || a.Deleted || a.Members != 1 || a.CreatedAt == nil || a.DeletedAt != nil {
+		t.Errorf("Got %+v, want active listed/a with one member", a)
+	}
+	if b.Name != "listed/b" || !b.Deleted || b.Members != 0 || b.DeletedAt == nil {
+		t.Errorf("Got %+v, want deleted listed/b", b)
+	}
+
+	page := list("v2/segments?prefix=listed/&limit=1")
+	if len(page.Segments) != 1 || page.Segments[0].Id != a.Id || page.NextAfter != a.Id {
+		t.Errorf("Got first page %+v", page)
+	}
+	page = list(fmt.Sprintf("v2/segments?prefix=listed/&limit=1&after=%d", page.NextAfter))
+	if len(page.Segments) != 1 || page.Segments[0].Id != b.Id {
+		t.Errorf("Got second page %+v", page)
+	}
+	if page = list("segments?prefix=listed/&state=active"); len(page.Segments) != 1 || page.Segments[0].Id != a.Id {
+		t.Errorf("Got active segments %+v", page)
+	}
+	if page = list("segments?prefix=listed/&state=deleted"); len(page.Segments) != 1 || page.Segments[0].Id != b.Id {
+		t.Errorf("Got deleted segments %+v", page)
+	}
+
+	for i, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"segments/listed%2Fb", 200, ""},
+		{"v2/segments/listed%20none", 404, `{"error":"name free","code":"name_free","field":"name","segment":"listed none"}`},
+		{"segments?state=gone", 400, `{"error":"state is not one of active, deleted, all","code":"bad_request","field":"state"}`},
+		{"segments?limit=0", 400, `{"error":"limit is not in 1..1000","code":"bad_request","field":"limit"}`},
+		{"segments?after=x", 400, `{"error":"bad segment id","code":"bad_request","field":"after"}`},
+	} {
+		status, body := request("GET", test.path, nil)
+		if status != test.status || (test.body != "" && body != test.body) {
+			t.Errorf("Failed test %d: got %d %s instead of %d %s", i+1, status, body, test.status, test.body)
+		}
+	}
+}
+
+func TestSegmentUsers(t *testing.T) {
+	for _, test := range []struct {
+		method, path string
+		payload      any
+		status       int
+	}{
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "members/a"}, 201},
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "members/empty"}, 201},
+		{"PATCH", "v2/users/4002/segments", web.UpdateUserSegmentsBody{AddToSegments: []web.SegmentAddition{{Name: "members/a"}}}, 204},
+		{"PATCH", "v2/users/4001/segments", web.UpdateUserSegmentsBody{AddToSegments: []web.SegmentAddition{{Name: "members/a"}}}, 204},
+		{"PATCH", "v2/users/4003/segments", web.UpdateUserSegmentsBody{AddToSegments: []web.SegmentAddition{{Name: "members/a"}}}, 204},
+	} {
+		if status, body := request(test.method, test.path, test.payload); status != test.status {
+			t.Fatalf("%s %s: got %d %s", test.method, test.path, status, body)
+		}
+	}
+
+	for i, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"segments/members%2Fa/users", 200, `{"users":[4001,4002,4003]}`},
+		{"segments/members%2Fa/users?limit=2", 200, `{"users":[4001,4002],"next_after":4002}`},
+		{"v2/segments/members%2Fa/users?limit=2&after=4002", 200, `{"users":[4003]}`},
+		{"segments/members%2Fa/users?count=true", 200, `{"count":3}`},
+		{"segments/members%2Fa/users?format=ndjson&after=4001", 200, "{\"user_id\":4002}\n{\"user_id\":4003}"},
+		{"segments/members%2Fa/users?format=csv&limit=1", 200, "user_id\n4001"},
+		{"segments/members%2Fempty/users", 200, `{"users":[]}`},
+		{"segments/members%2Fempty/users?format=csv", 200, "user_id"},
+		{"segments/members%2Fempty/users?count=1", 200, `{"count":0}`},
+		{"segments/members%2Fnone/users?format=ndjson", 404, `{"error":"name free","code":"name_free","field":"name","segment":"members/none"}`},
+		{"segments/members%2Fa/users?format=xml", 400, `{"error":"format is not one of json, ndjson, csv","code":"bad_request","field":"format"}`},
+		{"segments/members%2Fa/users?limit=10001", 400, `{"error":"limit is not in 1..10000","code":"bad_request","field":"limit"}`},
+		{"segments/members%2Fa/users?after=x", 400, `{"error":"bad user id","code":"bad_request","field":"after"}`},
+	} {
+		status, body := request("GET", test.path, nil)
+		if status != test.status || body != test.body {
+			t.Errorf("Failed test %d: got %d %s instead of %d %s", i+1, status, body, test.status, test.body)
+		}
+	}
+}
+
+func TestSegmentMetadata(t *testing.T) {
+	for i, test := range []struct {
+		method, path string
+		payload      any
+		status       int
+		body         string
+	}{
+		{"POST", "create_segment", map[string]any{
+			"name": "meta/a", "description": "Voice messages", "owner": "messenger",
+			"tags": []string{"voice", "mobile"}, "attributes": map[string]any{"jira": "VM-1"},
+		}, 200, `{"status":"ok"}`},
+		{"POST", "v2/segments", map[string]any{"name": "meta/b", "tags": []string{"mobile"}}, 201, ""},
+		{"POST", "v2/segments", map[string]any{"name": "meta/c", "attributes": []int{1}}, 422, `{"error":"bad attributes","code":"bad_attributes","field":"attributes","segment":"meta/c"}`},
+		{"POST", "v2/segments", map[string]any{"name": "meta/c", "tags": []string{""}}, 422, `{"error":"bad tag","code":"bad_tag","field":"tags","segment":"meta/c"}`},
+
+		{"POST", "update_segment", map[string]any{"name": "meta/a", "owner": "calls"}, 200, `{"status":"ok"}`},
+		{"POST", "update_segment", map[string]any{"name": "meta/none", "owner": "calls"}, 200, `{"status":"error","error":"name free","code":"name_free","field":"name","segment":"meta/none"}`},
+		{"PATCH", "v2/segments/meta%2Fa", map[string]any{"tags": []string{"voice"}, "attributes": map[string]any{"jira": "VM-2"}}, 204, ""},
+		{"PATCH", "v2/segments/meta%2Fa", map[string]any{"attributes": "VM-2"}, 422, ""},
+
+		{"GET", "segments/meta%2Fa", nil, 200, ""},
+		{"GET", "segments/meta%2Fb/history", nil, 200, `{"changes":[]}`},
+		{"GET", "segments/meta%2Fnone/history", nil, 404, ""},
+	} {
+		status, body := request(test.method, test.path, test.payload)
+		if status != test.status || (test.body != "" && body != test.body) {
+			t.Errorf("Failed test %d: got %d %s instead of %d %s", i+1, status, body, test.status, test.body)
+		}
+	}
+
+	// Creation answers with the segment as stored.
+	status, body := request("POST", "v2/segments", map[string]any{
+		"name": "meta/d", "tags": []string{"b", "a", "b"}, "attributes": map[string]any{"z": 1, "a": 2},
+	})
+	created := status
+	status, stored := request("GET", "v2/segments/meta%2Fd", nil)
+	if created != 201 || status != 200 || body != stored {
+		t.Errorf("Created %d %s, stored %d %s", created, body, status, stored)
+	}
+	status, body = request("POST", "v2/segments", map[string]any{"name": "meta/e", "attributes": nil})
+	var info web.SegmentInfo
+	if err := json.Unmarshal([]byte(body), &info); status != 201 || err != nil || string(info.Attributes) != "{}" {
+		t.Errorf("Null attributes: got %d %s", status, body)
+	}
+
+	status, body = request("GET", "segments/meta%2Fa", nil)
+	info = web.SegmentInfo{}
+	if err := json.Unmarshal([]byte(body), &info); status != 200 || err != nil {
+		t.Fatalf("Failed to inspect: %d %s", status, body)
+	}
+	if info.Description != "Voice messages" || info.Owner != "calls" ||
+		!reflect.DeepEqual(info.Tags, []string{"voice"}) || string(info.Attributes) != `{"jira":"VM-2"}` {
+		t.Errorf("Got %s", body)
+	}
+
+	status, body = request("GET", "segments?prefix=meta%2F&tag=mobile", nil)
+	var list web.ResponseSegmentList
+	if err := json.Unmarshal([]byte(body), &list); status != 200 || err != nil || len(list.Segments) != 1 || list.Segments[0].Name != "meta/b" {
+		t.Errorf("Got tagged segments %d %s, want meta/b", status, body)
+	}
+
+	status, body = request("GET", "v2/segments/meta%2Fa/history", nil)
+	var history web.ResponseSegmentHistory
+	if err := json.Unmarshal([]byte(body), &history); status != 200 || err != nil {
+		t.Fatalf("Failed to get history: %d %s", status, body)
+	}
+	var changes []string
+	for _, change := range history.Changes {
+		changes = append(changes, fmt.Sprintf("%s %s %s", change.Field, change.Old, change.New))
+	}
+	want := []string{
+		`owner "messenger" "calls"`,
+		`tags ["voice","mobile"] ["voice"]`,
+		`attributes {"jira":"VM-1"} {"jira":"VM-2"}`,
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Got changes %q, want %q", changes, want)
+	}
+}
+
+func TestSegmentPercent(t *testing.T) {
+	for i, test := range []struct {
+		method, path string
+		payload      any
+		status       int
+		body         string
+	}{
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "ramp/base"}, 201, ""},
+		{"POST", "v2/segments", web.CreateSegmentBody{Name: "ramp/auto"}, 201, ""},
+		{"PATCH", "v2/users/5001/segments", web.UpdateUserSegmentsBody{AddToSegments: []web.SegmentAddition{{Name: "ramp/base"}}}, 204, ""},
+
+		{"PATCH", "v2/segments/ramp%2Fauto", map[string]any{"percent": 100}, 204, ""},
+		{"GET", "segments/ramp%2Fauto/users?after=5000&limit=1", nil, 200, `{"users":[5001],"next_after":5001}`},
+		{"POST", "update_segment", map[string]any{"name": "ramp/auto", "percent": 0}, 200, `{"status":"ok"}`},
+		{"GET", "segments/ramp%2Fauto/users?after=5000&limit=1", nil, 200, `{"users":[]}`},
+
+		{"PATCH", "v2/segments/ramp%2Fauto", map[string]any{"percent": -1}, 422, `{"error":"bad percent","code":"bad_percent","field":"percent","segment":"ramp/auto"}`},
+		{"POST", "update_segment", map[string]any{"name": "ramp/auto", "percent": 101}, 200, `{"status":"error","error":"bad percent","code":"bad_percent","field":"percent","segment":"ramp/auto"}`},
+	} {
+		status, body := request(test.method, test.path, test.payload)
+		if status != test.status || (test.body != "" && body != test.body) {
+			t.Errorf("Failed test %d: got %d %s instead of %d %s", i+1, status, body, test.status, test.body)
+		}
+	}
+
+	status, body := request("GET", "segments/ramp%2Fauto/history", nil)
+	var history web.ResponseSegmentHistory
+	if err := json.Unmarshal([]byte(body), &history); status != 200 || err != nil || len(history.Changes) != 2 ||
+		history.Changes[1].Field != "automatic_percent" || string(history.Changes[1].New) != "0" {
+		t.Errorf("Got history %d %s", status, body)
+	}
+}
+
+func TestDeterministicSegment(t *testing.T) {
+	status, body := request("POST", "v2/segments", web.CreateSegmentBody{Name: "hash/random salt", Percent: 10, Deterministic: true})
+	var created web.SegmentInfo
+	if err := json.Unmarshal([]byte(body), &created); status != 201 || err != nil || created.Salt == "" {
+		t.Errorf("Got %d %s, want a salt", status, body)
+	}
+
+	status, body = request("POST", "v2/segments", web.CreateSegmentBody{Name: "hash/fixed", Percent: 50, Salt: "fixed"})
+	created = web.SegmentInfo{}
+	if err := json.Unmarshal([]byte(body), &created); status != 201 || err != nil ||
+		created.Salt != "fixed" || created.AutomaticPercent != 50 {
+		t.Errorf("Got %d %s", status, body)
+	}
+	status, body = request("GET", "segments/hash%2Ffixed", nil)
+	if status != 200 || !strings.Contains(body, `"salt":"fixed"`) {
+		t.Errorf("Got %d %s, want the salt", status, body)
+	}
+
+	for u := 6000; u < 6020; u++ {
+		request("PATCH", fmt.Sprintf("v2/users/%d/segments", u), web.UpdateUserSegmentsBody{})
+		_, body = request("GET", fmt.Sprintf("v2/users/%d/segments", u), nil)
+		in := strings.Contains(body, `"hash/fixed"`)
+		if want := db.Bucket("fixed", u) < 5000; in != want {
+			t.Errorf("User %d is in hash/fixed: %v, want %v", u, in, want)
+		}
+	}
+}
+
+func TestMembershipSource(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "source/explicit"})
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "source/ttl"})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{Id: 7000, AddToSegments: []web.SegmentAddition{{Name: "source/explicit"}}})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{Id: 7000, AddToSegments: []web.SegmentAddition{{Name: "source/ttl"}}, Ttl: 3600})
+
+	response := post[web.ResponseGetSegments]("get_segments", web.GetSegmentsBody{Id: 7000, Verbose: true})
+	sources := map[string]string{}
+	for _, membership := range response.Memberships {
+		sources[membership.Segment] = membership.Source
+		if membership.JoinedAt == nil {
+			t.Errorf("%s: no joined_at", membership.Segment)
+		}
+		if expires := membership.ExpiresAt != nil; expires != (membership.Segment == "source/ttl") {
+			t.Errorf("%s: expires_at %v", membership.Segment, membership.ExpiresAt)
+		}
+	}
+	if sources["source/explicit"] != "explicit" || sources["source/ttl"] != "ttl" || sources["hundred"] != "automatic" {
+		t.Errorf("Got %+v", response)
+	}
+	if len(response.Segments) != len(response.Memberships) {
+		t.Errorf("Got segments %q for memberships %+v", response.Segments, response.Memberships)
+	}
+
+	// Old clients see no memberships.
+	response = post[web.ResponseGetSegments]("get_segments", web.GetSegmentsBody{Id: 7000})
+	if response.Memberships != nil || len(response.Segments) == 0 {
+		t.Errorf("Got %+v", response)
+	}
+
+	for _, tc := range []struct {
+		query, want string
+		status      int
+	}{
+		{"?verbose=true", `{"segment":"source/ttl","source":"ttl","joined_at":`, 200},
+		{"", `"memberships"`, 200},
+		{"?verbose=maybe", `"field":"verbose"`, 400},
+	} {
+		status, body := request("GET", "v2/users/7000/segments"+tc.query, nil)
+		if status != tc.status || strings.Contains(body, tc.want) != (tc.query != "") {
+			t.Errorf("%q: got %d %s", tc.query, status, body)
+		}
+	}
+
+	post[web.ResponseUsual]("delete_segment", web.DeleteSegmentBody{Name: "source/ttl"})
+}
+
+func TestSegmentsBatch(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "batch"})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{Id: 7100, AddToSegments: []web.SegmentAddition{{Name: "batch"}}})
+
+	response := post[web.ResponseGetSegmentsBatch]("get_segments_batch", web.GetSegmentsBatchBody{Ids: []int32{7100, 7101}})
+	if response.Status != "ok" || len(response.Users) != 2 || len(response.Users[7101]) != 0 {
+		t.Errorf("Got %+v", response)
+	}
+	single := post[web.ResponseGetSegments]("get_segments", web.GetSegmentsBody{Id: 7100})
+	sort.Strings(single.Segments)
+	sort.Strings(response.Users[7100])
+	if !reflect.DeepEqual(response.Users[7100], single.Segments) {
+		t.Errorf("Got %q, want %q", response.Users[7100], single.Segments)
+	}
+
+	tooMany := make([]int32, 1001)
+	response = post[web.ResponseGetSegmentsBatch]("get_segments_batch", web.GetSegmentsBatchBody{Ids: tooMany})
+	if response.Status != "error" || response.Field != "ids" {
+		t.Errorf("Got %+v", response)
+	}
+
+	for _, tc := range []struct {
+		payload any
+		status  int
+		want    string
+	}{
+		{web.GetSegmentsBatchBody{Ids: []int32{7101}}, 200, `{"users":{"7101":[]}}`},
+		{web.GetSegmentsBatchBody{}, 200, `{"users":{}}`},
+		{web.GetSegmentsBatchBody{Ids: tooMany}, 400, `"field":"ids"`},
+	} {
+		status, body := request("POST", "v2/users/segments", tc.payload)
+		if status != tc.status || !strings.Contains(body, tc.want) {
+			t.Errorf("Got %d %s, want %d %s", status, body, tc.status, tc.want)
+		}
+	}
+}
+
+// upload makes a request with the raw body and returns the status code and
+// the body of the response.
+func upload(method, path, contentType, body string) (int, string) {
+	req, err := http.NewRequest(method, host+path, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		panic(err)
+	}
+	return resp.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestBulkUpdate(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "bulk"})
+
+	status, body := upload("POST", "update_users", "text/csv", "7200,bulk,add\n7201,bulk,add\nx,bulk,add\n7202,nope,add\n")
+	var response web.ResponseUpdateUsers
+	if err := json.Unmarshal([]byte(body), &response); status != 200 || err != nil || response.Status != "ok" ||
+		response.BulkResult == nil || response.Rows != 4 || response.Applied != 2 || response.Failed != 2 {
+		t.Fatalf("Got %d %s", status, body)
+	}
+	if failures := response.Failures; failures[0].Line != 3 || failures[0].Code != "bad_row" || failures[0].Field != "user_id" ||
+		failures[1].Line != 4 || failures[1].Code != "name_free" || failures[1].Segment != "nope" {
+		t.Errorf("Got failures %+v", failures)
+	}
+
+	status, body = upload("PATCH", "v2/users/segments", "application/x-ndjson", `{"user_id":7201,"segment":"bulk","op":"remove"}`)
+	if status != 200 || body != `{"rows":1,"applied":1,"failed":0,"failures":[]}` {
+		t.Errorf("Got %d %s", status, body)
+	}
+	status, body = upload("PATCH", "v2/users/segments?format=ndjson", "text/plain", "")
+	if status != 200 || body != `{"rows":0,"applied":0,"failed":0,"failures":[]}` {
+		t.Errorf("Got %d %s", status, body)
+	}
+	status, body = upload("PATCH", "v2/users/segments", "text/plain", "7201,bulk,add")
+	if status != 400 || !strings.Contains(body, `"field":"format"`) {
+		t.Errorf("Got %d %s", status, body)
+	}
+
+	batch := post[web.ResponseGetSegmentsBatch]("get_segments_batch", web.GetSegmentsBatchBody{Ids: []int32{7200, 7201}})
+	in := func(segments []string) bool {
+		for _, s := range segments {
+			if s == "bulk" {
+				return true
+			}
+		}
+		return false
+	}
+	if !in(batch.Users[7200]) || in(batch.Users[7201]) {
+		t.Errorf("Got %+v", batch)
+	}
+}
+
+func TestScheduled(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "scheduled"})
+	at := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	response := post[web.ResponseUsual]("update_user", web.UpdateUserBody{
+		Id:       7300,
+		AddAt:    map[string]time.Time{"scheduled": at},
+		RemoveAt: map[string]time.Time{"scheduled": at.Add(time.Hour), "nope": at},
+	})
+	if response.Status != "error" || response.Code != "name_free" || response.Field != "remove_at" || response.Segment != "nope" {
+		t.Errorf("Got %+v", response)
+	}
+
+	response = post[web.ResponseUsual]("update_user", web.UpdateUserBody{
+		Id:       7300,
+		AddAt:    map[string]time.Time{"scheduled": at},
+		RemoveAt: map[string]time.Time{"scheduled": at.Add(time.Hour)},
+	})
+	if response.Status != "ok" {
+		t.Errorf("Got %+v", response)
+	}
+
+	scheduled := post[web.ResponseGetScheduled]("get_scheduled", web.GetScheduledBody{Id: 7300})
+	want := []web.ScheduledOperation{
+		{Segment: "scheduled", Operation: "add", At: at, Source: "explicit"},
+		{Segment: "scheduled", Operation: "remove", At: at.Add(time.Hour), Source: "explicit"},
+	}
+	if scheduled.Status != "ok" || !reflect.DeepEqual(scheduled.Scheduled, want) {
+		t.Errorf("Got %+v, want %+v", scheduled, want)
+	}
+
+	status, body := request("GET", "v2/users/7300/scheduled", nil)
+	if status != 200 || !strings.HasPrefix(body, `{"scheduled":[{"segment":"scheduled","operation":"add","at":"`) {
+		t.Errorf("Got %d %s", status, body)
+	}
+	status, body = request("GET", "v2/users/7301/scheduled", nil)
+	if status != 200 || body != `{"scheduled":[]}` {
+		t.Errorf("Got %d %s", status, body)
+	}
+
+	post[web.ResponseUsual]("delete_segment", web.DeleteSegmentBody{Name: "scheduled"})
+}
+
+func TestSegmentExpiries(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "expiry/ttl"})
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "expiry/at"})
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "expiry/none"})
+	at := time.Now().Add(2 * time.Hour).UTC().Truncate(time.Second)
+
+	// Names and objects mix in one request.
+	status, body := request("POST", "update_user", json.RawMessage(fmt.Sprintf(
+		`{"id":7400,"add_to_segments":["expiry/none",{"name":"expiry/ttl","ttl":3600},{"name":"expiry/at","expires_at":%q}]}`,
+		at.Format(time.RFC3339))))
+	if status != 200 || body != `{"status":"ok"}` {
+		t.Errorf("Got %d %s", status, body)
+	}
+
+	scheduled := post[web.ResponseGetScheduled]("get_scheduled", web.GetScheduledBody{Id: 7400})
+	if len(scheduled.Scheduled) != 2 {
+		t.Fatalf("Got %+v", scheduled)
+	}
+	ttl, exact := scheduled.Scheduled[0], scheduled.Scheduled[1]
+	if ttl.Segment != "expiry/ttl" || ttl.Operation != "remove" || ttl.Source != "ttl" ||
+		ttl.At.Before(time.Now().Add(59*time.Minute)) || ttl.At.After(time.Now().Add(time.Hour)) {
+		t.Errorf("Got %+v, want removal from expiry/ttl in an hour", ttl)
+	}
+	if want := (web.ScheduledOperation{Segment: "expiry/at", Operation: "remove", At: at, Source: "ttl"}); exact != want {
+		t.Errorf("Got %+v, want %+v", exact, want)
+	}
+
+	response := post[web.ResponseUsual]("update_user", web.UpdateUserBody{
+		Id:            7400,
+		AddToSegments: []web.SegmentAddition{{Name: "expiry/none", Ttl: 60, ExpiresAt: &at}},
+	})
+	if response.Status != "error" || response.Code != "bad_request" || response.Field != "add_to_segments" {
+		t.Errorf("Got %+v", response)
+	}
+	status, body = request("PATCH", "v2/users/7400/segments",
+		json.RawMessage(`{"add_to_segments":[{"name":"expiry/none","ttl":-1}]}`))
+	if status != 400 || !strings.Contains(body, `"field":"add_to_segments"`) {
+		t.Errorf("Got %d %s", status, body)
+	}
+
+	for _, name := range []string{"expiry/ttl", "expiry/at", "expiry/none"} {
+		post[web.ResponseUsual]("delete_segment", web.DeleteSegmentBody{Name: name})
+	}
+}
+
+func TestRemovals(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "removals/a"})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{
+		Id: 7500, AddToSegments: []web.SegmentAddition{{Name: "removals/a"}}, Ttl: 3600,
+	})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{
+		Id: 7501, AddToSegments: []web.SegmentAddition{{Name: "removals/a"}}, Ttl: 7200,
+	})
+
+	later := time.Now().Add(3 * time.Hour).UTC().Truncate(time.Second)
+	response := post[web.ResponseUsual]("extend_removal", web.ExtendRemovalBody{Id: 7500, Segment: "removals/a", At: &later})
+	if response.Status != "ok" {
+		t.Errorf("Got %+v", response)
+	}
+	response = post[web.ResponseUsual]("extend_removal", web.ExtendRemovalBody{Id: 7502, Segment: "removals/a", Ttl: 60})
+	if response.Status != "error" || response.Code != "not_planned" || response.Segment != "removals/a" {
+		t.Errorf("Got %+v", response)
+	}
+	response = post[web.ResponseUsual]("extend_removal", web.ExtendRemovalBody{Id: 7500, Segment: "removals/a"})
+	if response.Status != "error" || response.Code != "bad_request" || response.Field != "ttl" {
+		t.Errorf("Got %+v", response)
+	}
+
+	status, body := request("GET", "segments/removals%2Fa/removals", nil)
+	if status != 200 || !strings.HasPrefix(body, `{"removals":[{"user_id":7501,"at":"`) ||
+		!strings.HasSuffix(body, fmt.Sprintf(`{"user_id":7500,"at":%q,"source":"ttl"}]}`, later.Format(time.RFC3339))) {
+		t.Errorf("Got %d %s", status, body)
+	}
+
+	// Pages go on after next_after.
+	status, body = request("GET", "segments/removals%2Fa/removals?limit=1", nil)
+	var page web.ResponseSegmentRemovals
+	if err := json.Unmarshal([]byte(body), &page); status != 200 || err != nil ||
+		len(page.Removals) != 1 || page.NextAfter == nil || page.NextAfter.UserId != 7501 {
+		t.Fatalf("Got first page %d %s", status, body)
+	}
+	query := url.Values{
+		"limit":         {"1"},
+		"after_at":      {page.NextAfter.At.Format(time.RFC3339Nano)},
+		"after_user_id": {"7501"},
+	}
+	status, body = request("GET", "segments/removals%2Fa/removals?"+query.Encode(), nil)
+	if status != 200 || !strings.HasPrefix(body, `{"removals":[{"user_id":7500,`) {
+		t.Errorf("Got second page %d %s", status, body)
+	}
+	for _, query := range []string{"limit=0", "after_at=yesterday&after_user_id=1", "after_at=2023-09-01T00:00:00Z"} {
+		if status, body = request("GET", "segments/removals%2Fa/removals?"+query, nil); status != 400 {
+			t.Errorf("%s: got %d %s, want 400", query, status, body)
+		}
+	}
+
+	response = post[web.ResponseUsual]("cancel_removal", web.CancelRemovalBody{Id: 7500, Segment: "removals/a"})
+	if response.Status != "ok" {
+		t.Errorf("Got %+v", response)
+	}
+
+	for i, test := range []struct {
+		method, path string
+		payload      any
+		status       int
+		body         string
+	}{
+		{"PATCH", "v2/users/7501/removals/removals%2Fa", web.PatchRemovalBody{Ttl: 60}, 204, ""},
+		{"PATCH", "v2/users/7500/removals/removals%2Fa", web.PatchRemovalBody{Ttl: 60}, 404,
+			`{"error":"not planned","code":"not_planned","field":"segment","segment":"removals/a"}`},
+		{"PATCH", "v2/users/7501/removals/removals%2Fa", web.PatchRemovalBody{Ttl: -1}, 400,
+			`{"error":"negative ttl","code":"bad_request","field":"ttl"}`},
+		{"DELETE", "v2/users/7501/removals/removals%2Fa", nil, 204, ""},
+		{"DELETE", "v2/users/7501/removals/removals%2Fa", nil, 404,
+			`{"error":"not planned","code":"not_planned","field":"segment","segment":"removals/a"}`},
+		{"GET", "v2/segments/removals%2Fa/removals", nil, 200, `{"removals":[]}`},
+		{"GET", "v2/segments/removals%2Fnone/removals", nil, 404,
+			`{"error":"name free","code":"name_free","field":"name","segment":"removals/none"}`},
+	} {
+		status, body := request(test.method, test.path, test.payload)
+		if status != test.status || body != test.body {
+			t.Errorf("%d. %s %s: got %d %s, want %d %s", i, test.method, test.path, status, body, test.status, test.body)
+		}
+	}
+
+	// Both stay for good.
+	status, body = request("GET", "segments/removals%2Fa/users", nil)
+	if status != 200 || body != `{"users":[7500,7501]}` {
+		t.Errorf("Got %d %s", status, body)
+	}
+
+	post[web.ResponseUsual]("delete_segment", web.DeleteSegmentBody{Name: "removals/a"})
+}
+
+func TestAsOf(t *testing.T) {
+	post[web.ResponseUsual]("create_segment", web.CreateSegmentBody{Name: "as of/a"})
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{Id: 7700, AddToSegments: []web.SegmentAddition{{Name: "as of/a"}}})
+	time.Sleep(20 * time.Millisecond)
+	joined := time.Now().UTC()
+	time.Sleep(20 * time.Millisecond)
+	post[web.ResponseUsual]("update_user", web.UpdateUserBody{Id: 7700, RemoveFromSegments: []string{"as of/a"}})
+
+	response := post[web.ResponseGetSegments]("get_segments", web.GetSegmentsBody{Id: 7700, AsOf: &joined})
+	found := false
+	for _, name := range response.Segments {
+		found = found || name == "as of/a"
+	}
+	if response.Status != "ok" || !found {
+		t.Errorf("Got %+v", response)
+	}
+	response = post[web.ResponseGetSegments]("get_segments", web.GetSegmentsBody{Id: 7700, AsOf: &joined, Verbose: true})
+	if response.Status != "error" || response.Code != "bad_request" || response.Field != "as_of" {
+		t.Errorf("Got %+v", response)
+	}
+
+	asOf := url.QueryEscape(joined.Format(time.RFC3339Nano))
+	for i, test := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"segments/as%20of%2Fa/users?as_of=" + asOf, 200, `{"users":[7700]}`},
+		{"segments/as%20of%2Fa/users?count=true&as_of=" + asOf, 200, `{"count":1}`},
+		{"segments/as%20of%2Fa/users", 200, `{"users":[]}`},
+		{"v2/users/7700/segments?as_of=yesterday", 400, `{"error":"parsing time \"yesterday\" as \"2006-01-02T15:04:05Z07:00\": cannot parse \"yesterday\" as \"2006\"","code":"bad_request","field":"as_of"}`},
+	} {
+		status, body := request("GET", test.path, nil)
+		if status != test.status || body != test.body {
+			t.Errorf("%d. %s: got %d %s, want %d %s", i, test.path, status, body, test.status, test.body)
+		}
+	}
+
+	status, body := request("GET", "v2/users/7700/segments?as_of="+asOf, nil)
+	if status != 200 || !strings.Contains(body, `"as of/a"`) {
+		t.Errorf("Got %d %s", status, body)
+	}
+
+	post[web.ResponseUsual]("delete_segment", web.DeleteSegmentBody{Name: "as of/a"})
 }
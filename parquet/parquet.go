@@ -0,0 +1,315 @@
+// Package parquet writes flat Parquet files with required columns. Values are
+// PLAIN-encoded in one gzipped data page per column chunk. Rows are buffered
+// until a row group is full, so a file of any size takes little memory.
+//
+// See https://parquet.apache.org/docs/file-format/ for the format.
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Type is the type of a column.
+type Type int
+
+const (
+	// Int32 values are int32.
+	Int32 Type = iota
+
+	// Int64 values are int64.
+	Int64
+
+	// String values are string, stored as UTF-8 byte arrays.
+	String
+
+	// Timestamp values are time.Time, stored as microseconds since the Unix
+	// epoch in UTC.
+	Timestamp
+)
+
+// Column is a required column of the file.
+type Column struct {
+	Name string
+	Type Type
+}
+
+// Rows in a row group. Readers load a row group of a column at once, so it
+// should be neither huge nor tiny.
+const groupRows = 64 << 10
+
+var magic = []byte("PAR1")
+
+// Physical types, repetition and converted types, encodings, codecs and page
+// types from parquet.thrift.
+const (
+	physicalInt32     = 1
+	physicalInt64     = 2
+	physicalByteArray = 6
+
+	required = 0
+
+	convertedUTF8            = 0
+	convertedTimestampMicros = 10
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+	codecGzip         = 2
+
+	pageData = 0
+)
+
+// Writer writes a Parquet file row by row.
+type Writer struct {
+	w       io.Writer
+	offset  int64
+	columns []Column
+	codec   int32 // Gzip unless tests need pages that do not depend on it.
+
+	// Plain values of the current row group by column.
+	values []bytes.Buffer
+	rows   int
+
+	groups    []rowGroup
+	totalRows int64
+	err       error
+}
+
+type rowGroup struct {
+	chunks []columnChunk
+	rows   int
+}
+
+type columnChunk struct {
+	offset             int64
+	uncompressed, size int64
+	values             int
+}
+
+// NewWriter writes the file to w. Call Close to finish it.
+func NewWriter(w io.Writer, columns []Column) (*Writer, error) {
+	if len(columns) == 0 {
+		return nil, errors.New("parquet: no columns")
+	}
+	pw := &Writer{w: w, columns: columns, codec: codecGzip, values: make([]bytes.Buffer, len(columns))}
+	pw.write(magic)
+	return pw, pw.err
+}
+
+// Write adds a row with a value for every column, in order.
+func (pw *Writer) Write(row ...any) error {
+	if pw.err != nil {
+		return pw.err
+	}
+	if len(row) != len(pw.columns) {
+		return fmt.Errorf("parquet: %d values for %d columns", len(row), len(pw.columns))
+	}
+	// Check all the values first, so that a bad row leaves no trace.
+	for i, value := range row {
+		if !pw.columns[i].Type.holds(value) {
+			return fmt.Errorf("parquet: column %s cannot hold %T", pw.columns[i].Name, value)
+		}
+	}
+
+	var b [8]byte
+	for i, value := range row {
+		buf := &pw.values[i]
+		switch v := value.(type) {
+		case int32:
+			binary.LittleEndian.PutUint32(b[:4], uint32(v))
+			buf.Write(b[:4])
+		case int64:
+			binary.LittleEndian.PutUint64(b[:], uint64(v))
+			buf.Write(b[:])
+		case string:
+			binary.LittleEndian.PutUint32(b[:4], uint32(len(v)))
+			buf.Write(b[:4])
+			buf.WriteString(v)
+		case time.Time:
+			binary.LittleEndian.PutUint64(b[:], uint64(v.UnixMicro()))
+			buf.Write(b[:])
+		}
+	}
+
+	pw.rows++
+	if pw.rows == groupRows {
+		pw.flushGroup()
+	}
+	return pw.err
+}
+
+func (t Type) holds(value any) bool {
+	switch value.(type) {
+	case int32:
+		return t == Int32
+	case int64:
+		return t == Int64
+	case string:
+		return t == String
+	case time.Time:
+		return t == Timestamp
+	}
+	return false
+}
+
+// Close writes the rows left and the footer. It does not close the underlying
+// writer.
+func (pw *Writer) Close() error {
+	if pw.err != nil {
+		return pw.err
+	}
+	pw.flushGroup()
+
+	footer := pw.footer()
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(footer)))
+	pw.write(footer)
+	pw.write(size[:])
+	pw.write(magic)
+	if pw.err == nil {
+		pw.err = errors.New("parquet: writer is closed")
+		return nil
+	}
+	return pw.err
+}
+
+func (pw *Writer) write(b []byte) {
+	if pw.err != nil {
+		return
+	}
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	pw.err = err
+}
+
+// flushGroup writes the buffered rows as a row group.
+func (pw *Writer) flushGroup() {
+	if pw.rows == 0 || pw.err != nil {
+		return
+	}
+
+	group := rowGroup{rows: pw.rows}
+	var page bytes.Buffer
+	for i := range pw.columns {
+		// Required columns have no levels, so the page is just values.
+		uncompressed := pw.values[i].Len()
+		page.Reset()
+		if pw.codec == codecGzip {
+			zw := gzip.NewWriter(&page)
+			_, _ = pw.values[i].WriteTo(zw)
+			if pw.err = zw.Close(); pw.err != nil {
+				return
+			}
+		} else {
+			_, _ = pw.values[i].WriteTo(&page)
+		}
+
+		var h compact
+		h.begin()
+		h.i32(1, pageData)
+		h.i32(2, int32(uncompressed))
+		h.i32(3, int32(page.Len()))
+		h.structField(5)
+		h.i32(1, int32(pw.rows))
+		h.i32(2, encodingPlain)
+		h.i32(3, encodingRLE)
+		h.i32(4, encodingRLE)
+		h.end()
+		h.end()
+
+		chunk := columnChunk{
+			offset:       pw.offset,
+			uncompressed: int64(len(h.buf) + uncompressed),
+			size:         int64(len(h.buf) + page.Len()),
+			values:       pw.rows,
+		}
+		pw.write(h.buf)
+		pw.write(page.Bytes())
+		if pw.err != nil {
+			return
+		}
+		group.chunks = append(group.chunks, chunk)
+	}
+
+	pw.groups = append(pw.groups, group)
+	pw.totalRows += int64(pw.rows)
+	pw.rows = 0
+}
+
+// footer returns FileMetaData of the file.
+func (pw *Writer) footer() []byte {
+	var m compact
+	m.begin()
+	m.i32(1, 1)
+
+	m.list(2, tStruct, len(pw.columns)+1)
+	m.begin()
+	m.str(4, "schema")
+	m.i32(5, int32(len(pw.columns)))
+	m.end()
+	for _, column := range pw.columns {
+		m.begin()
+		m.i32(1, column.Type.physical())
+		m.i32(3, required)
+		m.str(4, column.Name)
+		switch column.Type {
+		case String:
+			m.i32(6, convertedUTF8)
+		case Timestamp:
+			m.i32(6, convertedTimestampMicros)
+		}
+		m.end()
+	}
+
+	m.i64(3, pw.totalRows)
+
+	m.list(4, tStruct, len(pw.groups))
+	for _, group := range pw.groups {
+		m.begin()
+		m.list(1, tStruct, len(group.chunks))
+		var size int64
+		for i, chunk := range group.chunks {
+			size += chunk.uncompressed
+			m.begin()
+			m.i64(2, chunk.offset)
+			m.structField(3)
+			m.i32(1, pw.columns[i].Type.physical())
+			m.list(2, tI32, 2)
+			m.zigzag(encodingPlain)
+			m.zigzag(encodingRLE)
+			m.list(3, tBinary, 1)
+			m.rawString(pw.columns[i].Name)
+			m.i32(4, pw.codec)
+			m.i64(5, int64(chunk.values))
+			m.i64(6, chunk.uncompressed)
+			m.i64(7, chunk.size)
+			m.i64(9, chunk.offset)
+			m.end()
+			m.end()
+		}
+		m.i64(2, size)
+		m.i64(3, int64(group.rows))
+		m.end()
+	}
+
+	m.str(6, "avito2023")
+	m.end()
+	return m.buf
+}
+
+func (t Type) physical() int32 {
+	switch t {
+	case Int32:
+		return physicalInt32
+	case String:
+		return physicalByteArray
+	}
+	return physicalInt64
+}
@@ -0,0 +1,291 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"flag"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/golden.parquet")
+
+// decoder reads compact protocol into maps by field id, slices, int64 and
+// string, just enough to check the footer and page headers.
+type decoder struct {
+	b []byte
+	t *testing.T
+}
+
+func (d *decoder) varint() uint64 {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.t.Fatal("bad varint")
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) zigzag() int64 {
+	v := d.varint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (d *decoder) value(typ byte) any {
+	switch typ {
+	case tI32, tI64:
+		return d.zigzag()
+	case tBinary:
+		n := int(d.varint())
+		s := string(d.b[:n])
+		d.b = d.b[n:]
+		return s
+	case tList:
+		header := d.b[0]
+		d.b = d.b[1:]
+		n := int(header >> 4)
+		if n == 15 {
+			n = int(d.varint())
+		}
+		list := []any{}
+		for i := 0; i < n; i++ {
+			list = append(list, d.value(header&0x0f))
+		}
+		return list
+	case tStruct:
+		fields := map[int16]any{}
+		var last int16
+		for {
+			header := d.b[0]
+			d.b = d.b[1:]
+			if header == 0 {
+				return fields
+			}
+			if delta := int16(header >> 4); delta != 0 {
+				last += delta
+			} else {
+				last = int16(d.zigzag())
+			}
+			fields[last] = d.value(header & 0x0f)
+		}
+	}
+	d.t.Fatalf("unexpected type %d", typ)
+	return nil
+}
+
+func TestWriter(t *testing.T) {
+	columns := []Column{{"id", Int32}, {"name", String}, {"at", Timestamp}, {"n", Int64}}
+	at := time.Date(2023, 9, 1, 12, 0, 0, 123456000, time.FixedZone("MSK", 3*3600))
+
+	var file bytes.Buffer
+	w, err := NewWriter(&file, columns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := groupRows + 2
+	for i := 0; i < rows; i++ {
+		if err = w.Write(int32(i), "name", at, int64(-i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Write(1, "name", at, int64(0)); err == nil {
+		t.Error("wrote an int to an Int32 column")
+	}
+	if err = w.Write(int32(1)); err == nil {
+		t.Error("wrote a short row")
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := file.Bytes()
+	if !bytes.HasPrefix(b, magic) || !bytes.HasSuffix(b, magic) {
+		t.Fatal("no magic")
+	}
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	d := &decoder{b[len(b)-8-size : len(b)-8], t}
+	meta := d.value(tStruct).(map[int16]any)
+
+	if meta[3] != int64(rows) {
+		t.Errorf("got %v rows, want %d", meta[3], rows)
+	}
+	schema := meta[2].([]any)
+	if len(schema) != len(columns)+1 || schema[0].(map[int16]any)[5] != int64(len(columns)) {
+		t.Fatalf("got schema %v", schema)
+	}
+	for i, column := range columns {
+		element := schema[i+1].(map[int16]any)
+		if element[4] != column.Name || element[1] != int64(column.Type.physical()) {
+			t.Errorf("got schema element %v for %v", element, column)
+		}
+	}
+
+	groups := meta[4].([]any)
+	if len(groups) != 2 {
+		t.Fatalf("got %d row groups, want 2", len(groups))
+	}
+	last := groups[1].(map[int16]any)
+	if last[3] != int64(2) {
+		t.Errorf("got %v rows in the last group, want 2", last[3])
+	}
+
+	// The last group of every column holds the last two rows.
+	want := [][]byte{
+		make([]byte, 8),
+		[]byte("\x04\x00\x00\x00name\x04\x00\x00\x00name"),
+		nil,
+		nil,
+	}
+	binary.LittleEndian.PutUint32(want[0], uint32(rows-2))
+	binary.LittleEndian.PutUint32(want[0][4:], uint32(rows-1))
+	micros := make([]byte, 8)
+	binary.LittleEndian.PutUint64(micros, uint64(at.UnixMicro()))
+	want[2] = append(append([]byte{}, micros...), micros...)
+	want[3] = make([]byte, 16)
+	binary.LittleEndian.PutUint64(want[3], uint64(-int64(rows-2)))
+	binary.LittleEndian.PutUint64(want[3][8:], uint64(-int64(rows-1)))
+
+	for i, chunk := range last[1].([]any) {
+		meta := chunk.(map[int16]any)[3].(map[int16]any)
+		if path := meta[3].([]any); !reflect.DeepEqual(path, []any{columns[i].Name}) {
+			t.Errorf("got path %v, want %s", path, columns[i].Name)
+		}
+		offset, size := meta[9].(int64), meta[7].(int64)
+		d := &decoder{b[offset : offset+size], t}
+		header := d.value(tStruct).(map[int16]any)
+		if header[5].(map[int16]any)[1] != int64(2) {
+			t.Errorf("got page header %v, want 2 values", header)
+		}
+		if int64(len(d.b)) != header[3] {
+			t.Fatalf("got %d bytes of page, header says %v", len(d.b), header[3])
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(d.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		values, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(values, want[i]) {
+			t.Errorf("column %s: got values %x, want %x", columns[i].Name, values, want[i])
+		}
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	var file bytes.Buffer
+	w, err := NewWriter(&file, []Column{{"id", Int32}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	b := file.Bytes()
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	if len(b) != 4+size+8 {
+		t.Fatalf("got %d bytes with a footer of %d", len(b), size)
+	}
+	d := &decoder{b[4 : 4+size], t}
+	meta := d.value(tStruct).(map[int16]any)
+	if meta[3] != int64(0) || len(meta[4].([]any)) != 0 {
+		t.Errorf("got %v, want no rows", meta)
+	}
+}
+
+// pages returns the values of every page of the file, decompressed, by row
+// group and column.
+func pages(t *testing.T, b []byte) [][][]byte {
+	t.Helper()
+	size := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	meta := (&decoder{b[len(b)-8-size : len(b)-8], t}).value(tStruct).(map[int16]any)
+
+	var groups [][][]byte
+	for _, group := range meta[4].([]any) {
+		var columns [][]byte
+		for _, chunk := range group.(map[int16]any)[1].([]any) {
+			meta := chunk.(map[int16]any)[3].(map[int16]any)
+			offset, size := meta[9].(int64), meta[7].(int64)
+			d := &decoder{b[offset : offset+size], t}
+			d.value(tStruct) // Page header.
+			values := d.b
+			if meta[4] == int64(codecGzip) {
+				zr, err := gzip.NewReader(bytes.NewReader(d.b))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if values, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			columns = append(columns, values)
+		}
+		groups = append(groups, columns)
+	}
+	return groups
+}
+
+// TestGolden compares uncompressed files with testdata/golden.parquet byte for
+// byte, and the values of gzipped ones, whose bytes depend on the Go release.
+//
+// The golden file was read by github.com/xitongsys/parquet-go v1.6.2, the
+// library behind its parquet-tools. If the writer changes it on purpose,
+// rewrite it with go test ./parquet -update and read it with a real reader
+// again, like
+//
+//	python3 -c 'import pyarrow.parquet as pq; print(pq.read_table("parquet/testdata/golden.parquet").to_pylist())'
+//
+// It should show the rows below, stamps in UTC.
+func TestGolden(t *testing.T) {
+	columns := []Column{{"user_id", Int32}, {"segment", String}, {"stamp", Timestamp}, {"n", Int64}}
+	rows := [][]any{
+		{int32(1000), "AVITO_VOICE_MESSAGES", time.Date(2023, 9, 1, 12, 0, 0, 123456000, time.UTC), int64(1)},
+		{int32(-1), "", time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), int64(-1 << 40)},
+		{int32(2147483647), "скидки/30%", time.Date(2023, 9, 1, 15, 0, 0, 0, time.FixedZone("MSK", 3*3600)), int64(0)},
+	}
+	write := func(codec int32) []byte {
+		var file bytes.Buffer
+		w, err := NewWriter(&file, columns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.codec = codec
+		for _, row := range rows {
+			if err = w.Write(row...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return file.Bytes()
+	}
+
+	const golden = "testdata/golden.parquet"
+	got := write(codecUncompressed)
+	if *update {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		i := 0
+		for i < len(got) && i < len(want) && got[i] == want[i] {
+			i++
+		}
+		t.Errorf("got %d bytes, want %d as in %s, the first difference at %d", len(got), len(want), golden, i)
+	}
+
+	if got, want := pages(t, write(codecGzip)), pages(t, want); !reflect.DeepEqual(got, want) {
+		t.Errorf("got gzipped values %x, want %x as in %s", got, want, golden)
+	}
+}
@@ -0,0 +1,89 @@
+package parquet
+
+import "encoding/binary"
+
+// Parquet metadata is Thrift structs in the compact protocol. Only what the
+// writer needs is here.
+
+// Compact protocol types.
+const (
+	tI32    = 5
+	tI64    = 6
+	tBinary = 8
+	tList   = 9
+	tStruct = 12
+)
+
+type compact struct {
+	buf []byte
+
+	// Last field id of every open struct, the innermost last.
+	last []int16
+}
+
+func (c *compact) varint(v uint64) {
+	c.buf = binary.AppendUvarint(c.buf, v)
+}
+
+func (c *compact) zigzag(v int64) {
+	c.varint(uint64(v<<1) ^ uint64(v>>63))
+}
+
+func (c *compact) field(id int16, typ byte) {
+	last := &c.last[len(c.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		c.buf = append(c.buf, byte(delta)<<4|typ)
+	} else {
+		c.buf = append(c.buf, typ)
+		c.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (c *compact) begin() {
+	c.last = append(c.last, 0)
+}
+
+func (c *compact) end() {
+	c.buf = append(c.buf, 0)
+	c.last = c.last[:len(c.last)-1]
+}
+
+func (c *compact) i32(id int16, v int32) {
+	c.field(id, tI32)
+	c.zigzag(int64(v))
+}
+
+func (c *compact) i64(id int16, v int64) {
+	c.field(id, tI64)
+	c.zigzag(v)
+}
+
+func (c *compact) str(id int16, s string) {
+	c.field(id, tBinary)
+	c.varint(uint64(len(s)))
+	c.buf = append(c.buf, s...)
+}
+
+// list starts a list field. Elements follow: structs between begin and end,
+// numbers as zigzag and strings as rawString.
+func (c *compact) list(id int16, elem byte, n int) {
+	c.field(id, tList)
+	if n < 15 {
+		c.buf = append(c.buf, byte(n)<<4|elem)
+	} else {
+		c.buf = append(c.buf, 0xf0|elem)
+		c.varint(uint64(n))
+	}
+}
+
+func (c *compact) rawString(s string) {
+	c.varint(uint64(len(s)))
+	c.buf = append(c.buf, s...)
+}
+
+// structField starts a struct field. Close it with end.
+func (c *compact) structField(id int16) {
+	c.field(id, tStruct)
+	c.begin()
+}
@@ -0,0 +1,85 @@
+package web
+
+import (
+	"avito2023/db"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+)
+
+// bulkFormat returns the format of a bulk update body: the format query
+// parameter, or else the one of Content-Type.
+func bulkFormat(rq *http.Request) (string, error) {
+	switch format := rq.URL.Query().Get("format"); format {
+	case db.FormatCSV, db.FormatNDJSON:
+		return format, nil
+	case "":
+	default:
+		return "", badRequest("format", errors.New("format must be csv or ndjson"))
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(rq.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		return db.FormatCSV, nil
+	case "application/x-ndjson", "application/jsonl":
+		return db.FormatNDJSON, nil
+	}
+	return "", badRequest("format", errors.New("send text/csv or application/x-ndjson, or set format"))
+}
+
+// updateUsers applies the bulk update in the request body.
+func (h *handlers) updateUsers(rq *http.Request) (BulkResult, error) {
+	format, err := bulkFormat(rq)
+	if err != nil {
+		return BulkResult{}, err
+	}
+	rows, err := db.NewBulkReader(rq.Body, format)
+	if err != nil {
+		return BulkResult{}, err
+	}
+	result, err := h.store.UpdateUsers(rq.Context(), rows)
+	if err != nil {
+		return BulkResult{}, err
+	}
+
+	response := BulkResult{
+		Rows:     result.Rows,
+		Applied:  result.Applied,
+		Failed:   result.Failed,
+		Failures: make([]BulkFailure, len(result.Failures)),
+	}
+	for i, failure := range result.Failures {
+		message, details := explain(failure.Err)
+		response.Failures[i] = BulkFailure{Line: failure.Line, Err: message, ErrorDetails: details}
+	}
+	return response, nil
+}
+
+func (h *handlers) UpdateUsersPost(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	result, err := h.updateUsers(rq)
+	if err != nil {
+		failWithError(err, encoder)
+		return
+	}
+
+	_ = encoder.Encode(ResponseUpdateUsers{
+		Status:     "ok",
+		BulkResult: &result,
+	})
+}
+
+func (h *handlers) UsersSegmentsPatchV2(w http.ResponseWriter, rq *http.Request) {
+	result, err := h.updateUsers(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,77 @@
+package web
+
+import (
+	"avito2023/db"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+)
+
+// Error codes of package web. See db.Code* for the rest.
+const (
+	codeBadRequest = "bad_request"
+	codeBadTime    = "bad_time"
+)
+
+var errBadTime = &db.Error{Code: codeBadTime, Message: "bad time"}
+
+// badRequest wraps errors of parsing requests.
+func badRequest(field string, err error) error {
+	return &db.Error{Code: codeBadRequest, Message: err.Error(), Field: field}
+}
+
+// explain turns err into what clients see. Internal errors are logged with a
+// random id, and clients get only the id.
+func explain(err error) (string, ErrorDetails) {
+	e := db.AsError(err)
+	details := ErrorDetails{
+		Code:      e.Code,
+		Field:     e.Field,
+		Segment:   e.Segment,
+		Retryable: e.Retryable,
+	}
+	if e.Code == db.CodeInternal {
+		details.ErrorId = newErrorId()
+		log.Printf("Internal error %s: %v\n", details.ErrorId, e.Internal)
+	}
+	return e.Message, details
+}
+
+func newErrorId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusOf maps errors to HTTP status codes.
+func statusOf(err error) int {
+	switch db.AsError(err).Code {
+	case codeBadRequest:
+		return http.StatusBadRequest
+	case db.CodeNameEmpty, db.CodeBadPercent, db.CodeBadTag, db.CodeBadAttributes, db.CodeBadRow, codeBadTime:
+		return http.StatusUnprocessableEntity
+	case db.CodeNameFree, db.CodeNotPlanned:
+		return http.StatusNotFound
+	case db.CodeNameTaken, db.CodeSegmentDeleted:
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// fail responds with the error in v2 style.
+func fail(w http.ResponseWriter, err error) {
+	message, details := explain(err)
+	writeJSON(w, statusOf(err), ResponseError{Err: message, ErrorDetails: details})
+}
+
+// abortStream logs why a streamed response is cut short and breaks the
+// connection. The status is sent by then, and a chunked body or gzip stream
+// that never ends keeps the client from taking the part for the whole.
+func abortStream(format string, v ...any) {
+	log.Printf(format, v...)
+	panic(http.ErrAbortHandler)
+}
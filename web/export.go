@@ -0,0 +1,261 @@
+package web
+
+import (
+	"avito2023/db"
+	"avito2023/parquet"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// History files come in formats. The default one is semicolon-separated
+// without a header, with Go stamps, as it has always been.
+var historyFormats = map[string]struct {
+	contentType, extension string
+}{
+	"":        {"text/csv; charset=UTF-8", "csv"},
+	"csv":     {"text/csv; charset=UTF-8", "csv"},
+	"tsv":     {"text/tab-separated-values; charset=UTF-8", "tsv"},
+	"json":    {"application/json; charset=UTF-8", "json"},
+	"ndjson":  {"application/x-ndjson", "ndjson"},
+	"parquet": {"application/vnd.apache.parquet", "parquet"},
+}
+
+// historyColumns are all the columns of history files in the default order.
+var historyColumns = []parquet.Column{
+	{Name: "user_id", Type: parquet.Int32},
+	{Name: "segment", Type: parquet.String},
+	{Name: "operation", Type: parquet.String},
+	{Name: "stamp", Type: parquet.Timestamp},
+	{Name: "source", Type: parquet.String},
+}
+
+// historyExport is how to write the history file.
+type historyExport struct {
+	format  string
+	columns []parquet.Column
+}
+
+// export checks the format and the columns of the body.
+func (body HistoryBody) export() (historyExport, error) {
+	export := historyExport{format: body.Format, columns: historyColumns}
+	if _, ok := historyFormats[body.Format]; !ok {
+		return export, badRequest("format", errors.New("format is not one of csv, tsv, json, ndjson, parquet"))
+	}
+	if len(body.Columns) == 0 {
+		return export, nil
+	}
+
+	export.columns = nil
+	for _, name := range body.Columns {
+		var column *parquet.Column
+		for i := range historyColumns {
+			if historyColumns[i].Name == name {
+				column = &historyColumns[i]
+			}
+		}
+		if column == nil {
+			return export, badRequest("columns", fmt.Errorf("unknown column %q", name))
+		}
+		for _, c := range export.columns {
+			if c.Name == name {
+				return export, badRequest("columns", fmt.Errorf("column %q is repeated", name))
+			}
+		}
+		export.columns = append(export.columns, *column)
+	}
+	return export, nil
+}
+
+// historyValue returns the column of the record as int32, string or time.Time.
+func historyValue(column string, record db.HistoryRecord) any {
+	switch column {
+	case "user_id":
+		return int32(record.UserId)
+	case "segment":
+		return record.Segment
+	case "operation":
+		return record.Operation
+	case "stamp":
+		return record.Stamp
+	}
+	return record.Source
+}
+
+// historyWriter writes records of the history file.
+type historyWriter interface {
+	Write(record db.HistoryRecord) error
+
+	// Flush sends the records written so far, if the format allows.
+	Flush() error
+
+	// Close finishes the file.
+	Close() error
+}
+
+func newHistoryWriter(w io.Writer, export historyExport, loc *time.Location) (historyWriter, error) {
+	switch export.format {
+	case "json", "ndjson":
+		return &jsonHistory{w: bufio.NewWriter(w), columns: export.columns, loc: loc, array: export.format == "json"}, nil
+	case "parquet":
+		// Stamps are instants in UTC there, readers show them in any zone.
+		pw, err := parquet.NewWriter(w, export.columns)
+		return parquetHistory{pw, export.columns}, err
+	}
+
+	h := &csvHistory{doc: csv.NewWriter(w), columns: export.columns, loc: loc, stampLayout: time.RFC3339Nano}
+	switch export.format {
+	case "":
+		h.doc.Comma = ';'
+		h.stampLayout = ""
+		return h, nil
+	case "tsv":
+		h.doc.Comma = '\t'
+	}
+	names := make([]string, len(export.columns))
+	for i, column := range export.columns {
+		names[i] = column.Name
+	}
+	return h, h.doc.Write(names)
+}
+
+type csvHistory struct {
+	doc     *csv.Writer
+	columns []parquet.Column
+	loc     *time.Location
+
+	// Empty for time.Time.String.
+	stampLayout string
+
+	line []string
+}
+
+func (h *csvHistory) Write(record db.HistoryRecord) error {
+	h.line = h.line[:0]
+	for _, column := range h.columns {
+		var field string
+		switch v := historyValue(column.Name, record).(type) {
+		case int32:
+			field = strconv.Itoa(int(v))
+		case string:
+			field = v
+		case time.Time:
+			if h.stampLayout == "" {
+				field = v.In(h.loc).String()
+			} else {
+				field = v.In(h.loc).Format(h.stampLayout)
+			}
+		}
+		h.line = append(h.line, field)
+	}
+	return h.doc.Write(h.line)
+}
+
+func (h *csvHistory) Flush() error {
+	h.doc.Flush()
+	return h.doc.Error()
+}
+
+func (h *csvHistory) Close() error {
+	return h.Flush()
+}
+
+// jsonHistory writes records as JSON objects with columns as keys, either
+// one per line or in an array.
+type jsonHistory struct {
+	w       *bufio.Writer
+	columns []parquet.Column
+	loc     *time.Location
+	array   bool
+
+	written bool
+	line    []byte
+}
+
+func (h *jsonHistory) Write(record db.HistoryRecord) error {
+	h.line = h.line[:0]
+	switch {
+	case h.array && !h.written:
+		h.line = append(h.line, "[\n"...)
+	case h.array:
+		h.line = append(h.line, ",\n"...)
+	}
+	h.written = true
+
+	h.line = append(h.line, '{')
+	for i, column := range h.columns {
+		if i > 0 {
+			h.line = append(h.line, ',')
+		}
+		h.line = strconv.AppendQuote(h.line, column.Name)
+		h.line = append(h.line, ':')
+		value := historyValue(column.Name, record)
+		if stamp, ok := value.(time.Time); ok {
+			value = stamp.In(h.loc)
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		h.line = append(h.line, b...)
+	}
+	h.line = append(h.line, '}')
+	if !h.array {
+		h.line = append(h.line, '\n')
+	}
+	_, err := h.w.Write(h.line)
+	return err
+}
+
+func (h *jsonHistory) Flush() error {
+	return h.w.Flush()
+}
+
+func (h *jsonHistory) Close() error {
+	if h.array {
+		end := "\n]\n"
+		if !h.written {
+			end = "[]\n"
+		}
+		if _, err := h.w.WriteString(end); err != nil {
+			return err
+		}
+	}
+	return h.w.Flush()
+}
+
+type parquetHistory struct {
+	pw      *parquet.Writer
+	columns []parquet.Column
+}
+
+func (h parquetHistory) Write(record db.HistoryRecord) error {
+	row := make([]any, len(h.columns))
+	for i, column := range h.columns {
+		row[i] = historyValue(column.Name, record)
+	}
+	return h.pw.Write(row...)
+}
+
+// Flush does nothing: row groups are written when they are full.
+func (h parquetHistory) Flush() error {
+	return nil
+}
+
+func (h parquetHistory) Close() error {
+	return h.pw.Close()
+}
+
+// historyColumnsOf splits the columns parameter of GET /history.
+func historyColumnsOf(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
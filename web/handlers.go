@@ -4,21 +4,26 @@ import (
 	"avito2023/db"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
 )
 
+// handlers serve HTTP requests using the store.
+type handlers struct {
+	store db.SegmentStore
+}
+
 func index(w http.ResponseWriter, rq *http.Request) {
 	_, _ = fmt.Fprintf(w, "Avito!")
 }
 
 func failWithError(err error, encoder *json.Encoder) {
+	message, details := explain(err)
 	response := ResponseUsual{
-		Status: "error",
-		Err:    err.Error(),
+		Status:       "error",
+		Err:          message,
+		ErrorDetails: details,
 	}
 
 	err = encoder.Encode(response)
@@ -28,9 +33,11 @@ func failWithError(err error, encoder *json.Encoder) {
 }
 
 func failWithGetError(err error, encoder *json.Encoder) {
+	message, details := explain(err)
 	response := ResponseGetSegments{
-		Status: "error",
-		Err:    err.Error(),
+		Status:       "error",
+		Err:          message,
+		ErrorDetails: details,
 	}
 
 	err = encoder.Encode(response)
@@ -40,9 +47,11 @@ func failWithGetError(err error, encoder *json.Encoder) {
 }
 
 func failWithHistoryError(err error, encoder *json.Encoder) {
+	message, details := explain(err)
 	response := ResponseHistory{
-		Status: "error",
-		Err:    err.Error(),
+		Status:       "error",
+		Err:          message,
+		ErrorDetails: details,
 	}
 
 	err = encoder.Encode(response)
@@ -59,7 +68,7 @@ func alright(encoder *json.Encoder) {
 	}
 }
 
-func CreateSegmentPost(w http.ResponseWriter, rq *http.Request) {
+func (h *handlers) CreateSegmentPost(w http.ResponseWriter, rq *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
@@ -70,12 +79,18 @@ func CreateSegmentPost(w http.ResponseWriter, rq *http.Request) {
 	)
 
 	err := decoder.Decode(&body)
+	if err != nil {
+		failWithError(badRequest("", err), encoder)
+		return
+	}
+
+	salt, err := body.salt()
 	if err != nil {
 		failWithError(err, encoder)
 		return
 	}
 
-	err = db.CreateSegment(context.Background(), body.Name, uint(body.Percent))
+	err = h.store.CreateSegment(context.Background(), body.Name, uint(body.Percent), salt, body.meta())
 	if err != nil {
 		failWithError(err, encoder)
 		return
@@ -84,23 +99,48 @@ func CreateSegmentPost(w http.ResponseWriter, rq *http.Request) {
 	alright(encoder)
 }
 
-func DeleteSegmentPost(w http.ResponseWriter, rq *http.Request) {
+func (h *handlers) UpdateSegmentPost(w http.ResponseWriter, rq *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
 	var (
-		body    DeleteSegmentBody
+		body    UpdateSegmentBody
 		decoder = json.NewDecoder(rq.Body)
 		encoder = json.NewEncoder(w)
 	)
 
 	err := decoder.Decode(&body)
+	if err != nil {
+		failWithError(badRequest("", err), encoder)
+		return
+	}
+
+	err = h.store.UpdateSegment(context.Background(), body.Name, body.update())
 	if err != nil {
 		failWithError(err, encoder)
 		return
 	}
 
-	err = db.DeleteSegment(context.Background(), body.Name)
+	alright(encoder)
+}
+
+func (h *handlers) DeleteSegmentPost(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	var (
+		body    DeleteSegmentBody
+		decoder = json.NewDecoder(rq.Body)
+		encoder = json.NewEncoder(w)
+	)
+
+	err := decoder.Decode(&body)
+	if err != nil {
+		failWithError(badRequest("", err), encoder)
+		return
+	}
+
+	err = h.store.DeleteSegment(context.Background(), body.Name)
 	if err != nil {
 		failWithError(err, encoder)
 		return
@@ -109,7 +149,7 @@ func DeleteSegmentPost(w http.ResponseWriter, rq *http.Request) {
 	alright(encoder)
 }
 
-func GetSegmentsPost(w http.ResponseWriter, rq *http.Request) {
+func (h *handlers) GetSegmentsPost(w http.ResponseWriter, rq *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
@@ -121,101 +161,220 @@ func GetSegmentsPost(w http.ResponseWriter, rq *http.Request) {
 
 	err := decoder.Decode(&body)
 	if err != nil {
-		failWithGetError(err, encoder)
+		failWithGetError(badRequest("", err), encoder)
 		return
 	}
 
-	segments, err := db.GetSegments(context.Background(), int(body.Id))
+	var (
+		segments    []string
+		memberships []Membership
+	)
+	switch {
+	case body.AsOf != nil && body.Verbose:
+		err = badRequest("as_of", errVerboseAsOf)
+	case body.AsOf != nil:
+		segments, err = h.store.GetSegmentsAsOf(context.Background(), int(body.Id), *body.AsOf)
+	case body.Verbose:
+		var found []db.Membership
+		found, err = h.store.GetMemberships(context.Background(), int(body.Id))
+		segments, memberships = membershipsOf(found)
+	default:
+		segments, err = h.store.GetSegments(context.Background(), int(body.Id))
+	}
 	if err != nil {
 		failWithGetError(err, encoder)
 		return
 	}
 
 	_ = encoder.Encode(ResponseGetSegments{
-		Status:   "ok",
-		Segments: segments,
+		Status:      "ok",
+		Segments:    segments,
+		Memberships: memberships,
 	})
 }
 
-func UpdateUserPost(w http.ResponseWriter, rq *http.Request) {
+// membershipsOf returns segment names and memberships for responses.
+func membershipsOf(memberships []db.Membership) ([]string, []Membership) {
+	segments := make([]string, len(memberships))
+	result := make([]Membership, len(memberships))
+	for i, membership := range memberships {
+		segments[i] = membership.Segment
+		result[i] = Membership{Segment: membership.Segment, Source: membership.Source}
+		if !membership.JoinedAt.IsZero() {
+			result[i].JoinedAt = timePtr(membership.JoinedAt)
+		}
+		if !membership.ExpiresAt.IsZero() {
+			result[i].ExpiresAt = timePtr(membership.ExpiresAt)
+		}
+	}
+	return segments, result
+}
+
+func (h *handlers) GetSegmentsBatchPost(w http.ResponseWriter, rq *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
 	var (
-		body    UpdateUserBody
+		body    GetSegmentsBatchBody
 		decoder = json.NewDecoder(rq.Body)
 		encoder = json.NewEncoder(w)
 	)
 
 	err := decoder.Decode(&body)
+	if err != nil {
+		failWithError(badRequest("", err), encoder)
+		return
+	}
+
+	userIds, err := body.userIds()
 	if err != nil {
 		failWithError(err, encoder)
 		return
 	}
 
-	err = db.UpdateUser(context.Background(), int(body.Id), body.AddToSegments, body.RemoveFromSegments, int(body.Ttl))
+	users, err := h.store.GetSegmentsBatch(context.Background(), userIds)
 	if err != nil {
 		failWithError(err, encoder)
 		return
 	}
 
-	alright(encoder)
+	_ = encoder.Encode(ResponseGetSegmentsBatch{
+		Status: "ok",
+		Users:  users,
+	})
 }
 
-func showErrorStatus(w http.ResponseWriter, statusCode int) {
-	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
-	w.WriteHeader(statusCode)
-	_, _ = fmt.Fprintln(w, fmt.Sprintf("%d", statusCode))
-}
+func (h *handlers) GetScheduledPost(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
 
-func HistoryGet(w http.ResponseWriter, rq *http.Request) {
 	var (
-		year, errYear   = strconv.Atoi(rq.FormValue("year"))
-		month, errMonth = strconv.Atoi(rq.FormValue("month"))
+		body    GetScheduledBody
+		decoder = json.NewDecoder(rq.Body)
+		encoder = json.NewEncoder(w)
 	)
 
-	if errYear != nil || errMonth != nil || year < 2023 || month < 1 || month > 12 {
-		showErrorStatus(w, http.StatusNotFound)
+	err := decoder.Decode(&body)
+	if err != nil {
+		failWithError(badRequest("", err), encoder)
 		return
 	}
 
-	csv, err := db.GetHistory(context.Background(), year, month)
+	plans, err := h.store.GetPlans(context.Background(), int(body.Id))
 	if err != nil {
-		log.Println(err)
-		showErrorStatus(w, http.StatusInternalServerError)
+		failWithError(err, encoder)
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	_ = encoder.Encode(ResponseGetScheduled{
+		Status:    "ok",
+		Scheduled: scheduledOperations(plans),
+	})
+}
+
+func (h *handlers) ExtendRemovalPost(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
-	_, _ = fmt.Fprintln(w, csv)
+
+	var (
+		body    ExtendRemovalBody
+		decoder = json.NewDecoder(rq.Body)
+		encoder = json.NewEncoder(w)
+	)
+
+	err := decoder.Decode(&body)
+	if err != nil {
+		failWithError(badRequest("", err), encoder)
+		return
+	}
+
+	at, err := removalAt(body.Ttl, body.At)
+	if err != nil {
+		failWithError(err, encoder)
+		return
+	}
+
+	err = h.store.ExtendRemoval(context.Background(), int(body.Id), body.Segment, at)
+	if err != nil {
+		failWithError(err, encoder)
+		return
+	}
+
+	alright(encoder)
 }
 
-func HistoryPost(w http.ResponseWriter, rq *http.Request) {
+func (h *handlers) CancelRemovalPost(w http.ResponseWriter, rq *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusOK)
 
 	var (
-		body    HistoryBody
+		body    CancelRemovalBody
 		decoder = json.NewDecoder(rq.Body)
 		encoder = json.NewEncoder(w)
 	)
 
-	encoder.SetEscapeHTML(false)
+	err := decoder.Decode(&body)
+	if err != nil {
+		failWithError(badRequest("", err), encoder)
+		return
+	}
+
+	err = h.store.CancelRemoval(context.Background(), int(body.Id), body.Segment)
+	if err != nil {
+		failWithError(err, encoder)
+		return
+	}
+
+	alright(encoder)
+}
+
+func scheduledOperations(plans []db.Plan) []ScheduledOperation {
+	operations := make([]ScheduledOperation, len(plans))
+	for i, plan := range plans {
+		operations[i] = ScheduledOperation{
+			Segment:   plan.Segment,
+			Operation: plan.Operation,
+			At:        plan.At.UTC(),
+			Source:    plan.Source,
+		}
+	}
+	return operations
+}
+
+func (h *handlers) UpdateUserPost(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	var (
+		body    UpdateUserBody
+		decoder = json.NewDecoder(rq.Body)
+		encoder = json.NewEncoder(w)
+	)
 
 	err := decoder.Decode(&body)
 	if err != nil {
-		failWithHistoryError(err, encoder)
+		failWithError(badRequest("", err), encoder)
+		return
+	}
+
+	addTo, expiries, err := additions(body.AddToSegments, body.RemoveAt)
+	if err != nil {
+		failWithError(err, encoder)
 		return
 	}
 
-	if body.Year < 2023 || body.Month < 1 || body.Month > 12 {
-		failWithHistoryError(errors.New("bad time"), encoder)
+	err = h.store.UpdateUser(context.Background(), int(body.Id), addTo, body.RemoveFromSegments, int(body.Ttl),
+		append(expiries, plans(body.AddAt, body.RemoveAt)...)...)
+	if err != nil {
+		failWithError(err, encoder)
 		return
 	}
 
-	_ = encoder.Encode(ResponseHistory{
-		Status: "ok",
-		Link:   fmt.Sprintf("/history?year=%d&month=%d", body.Year, body.Month),
-	})
+	alright(encoder)
+}
+
+func showErrorStatus(w http.ResponseWriter, statusCode int) {
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	w.WriteHeader(statusCode)
+	_, _ = fmt.Fprintln(w, fmt.Sprintf("%d", statusCode))
 }
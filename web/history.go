@@ -0,0 +1,342 @@
+package web
+
+import (
+	"avito2023/db"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	// Images might have no time zone database.
+	_ "time/tzdata"
+)
+
+// The history file is flushed every this many records.
+const historyFlush = 1000
+
+// filter checks the body and converts it for the store.
+func (body HistoryBody) filter() (db.HistoryFilter, error) {
+	filter := db.HistoryFilter{Segment: body.Segment}
+
+	loc, err := body.location()
+	if err != nil {
+		return filter, err
+	}
+
+	switch {
+	case body.Year == 0 && body.Month == 0 && body.From == nil:
+		// Not the whole table at once, as it has always been.
+		return filter, errBadTime
+	case body.Year == 0 && body.Month == 0:
+		filter.From = *body.From
+		if body.To != nil {
+			filter.To = *body.To
+		}
+		if body.From != nil && body.To != nil && !filter.From.Before(filter.To) {
+			return filter, errBadTime
+		}
+	case body.Year < 2023 || body.Month < 1 || body.Month > 12:
+		return filter, errBadTime
+	case body.From != nil || body.To != nil:
+		return filter, badRequest("from", errors.New("from and to cannot be used with year and month"))
+	default:
+		filter.From = time.Date(int(body.Year), time.Month(body.Month), 1, 0, 0, 0, 0, loc)
+		filter.To = filter.From.AddDate(0, 1, 0)
+	}
+
+	if body.UserId != nil {
+		userId := int(*body.UserId)
+		filter.UserId = &userId
+	}
+
+	switch body.Operation {
+	case "", db.OpAdd, db.OpRemove:
+		filter.Operation = body.Operation
+	default:
+		return filter, badRequest("operation", errors.New("operation is not one of add, remove"))
+	}
+	return filter, nil
+}
+
+// location returns the time zone of stamps, UTC by default.
+func (body HistoryBody) location() (*time.Location, error) {
+	if body.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(body.Timezone)
+	if err != nil {
+		return nil, badRequest("timezone", err)
+	}
+	return loc, nil
+}
+
+// filename names the history file after the month and the user, if any, with
+// the extension of the format.
+func (body HistoryBody) filename() string {
+	name := "history"
+	if body.Year != 0 || body.Month != 0 {
+		name += fmt.Sprintf("-%04d-%02d", body.Year, body.Month)
+	}
+	if body.UserId != nil {
+		name += fmt.Sprintf("-user-%d", *body.UserId)
+	}
+	return name + "." + historyFormats[body.Format].extension
+}
+
+// query returns the body as GET /history parameters, year and month first.
+func (body HistoryBody) query() string {
+	var params []string
+	add := func(key, value string) {
+		params = append(params, key+"="+url.QueryEscape(value))
+	}
+	if body.Year != 0 || body.Month != 0 {
+		add("year", strconv.Itoa(int(body.Year)))
+		add("month", strconv.Itoa(int(body.Month)))
+	}
+	if body.From != nil {
+		add("from", body.From.Format(time.RFC3339Nano))
+	}
+	if body.To != nil {
+		add("to", body.To.Format(time.RFC3339Nano))
+	}
+	if body.UserId != nil {
+		add("user_id", strconv.Itoa(int(*body.UserId)))
+	}
+	if body.Segment != "" {
+		add("segment", body.Segment)
+	}
+	if body.Operation != "" {
+		add("operation", body.Operation)
+	}
+	if body.Timezone != "" {
+		add("timezone", body.Timezone)
+	}
+	if body.Format != "" {
+		add("format", body.Format)
+	}
+	if len(body.Columns) != 0 {
+		add("columns", strings.Join(body.Columns, ","))
+	}
+	return strings.Join(params, "&")
+}
+
+// historyBodyOf reads GET /history parameters.
+func historyBodyOf(rq *http.Request) (HistoryBody, error) {
+	var (
+		query = rq.URL.Query()
+		body  = HistoryBody{
+			Segment:   query.Get("segment"),
+			Operation: query.Get("operation"),
+			Timezone:  query.Get("timezone"),
+			Format:    query.Get("format"),
+			Columns:   historyColumnsOf(query.Get("columns")),
+		}
+	)
+
+	if query.Get("year") != "" || query.Get("month") != "" {
+		year, errYear := strconv.ParseInt(query.Get("year"), 10, 32)
+		month, errMonth := strconv.ParseInt(query.Get("month"), 10, 32)
+		if errYear != nil || errMonth != nil {
+			return body, errBadTime
+		}
+		body.Year, body.Month = int32(year), int32(month)
+	}
+
+	for _, param := range []struct {
+		name string
+		to   **time.Time
+	}{
+		{"from", &body.From},
+		{"to", &body.To},
+	} {
+		if s := query.Get(param.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return body, badRequest(param.name, err)
+			}
+			*param.to = &t
+		}
+	}
+
+	if s := query.Get("user_id"); s != "" {
+		userId, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return body, badRequest("user_id", errors.New("bad user id"))
+		}
+		id := int32(userId)
+		body.UserId = &id
+	}
+	return body, nil
+}
+
+// historyStatus is statusOf for GET /history, which has always answered 404
+// to bad months.
+func historyStatus(err error) int {
+	if errors.Is(err, errBadTime) {
+		return http.StatusNotFound
+	}
+	return statusOf(err)
+}
+
+// HistoryGet streams the history file. Headers are sent with the first
+// record, so errors before it get a proper response. Errors after it abort the
+// connection, so that a file cut short does not pass for a complete one.
+func (h *handlers) HistoryGet(w http.ResponseWriter, rq *http.Request) {
+	body, err := historyBodyOf(rq)
+	if err != nil {
+		showErrorStatus(w, historyStatus(err))
+		return
+	}
+	filter, err := body.filter()
+	if err != nil {
+		showErrorStatus(w, historyStatus(err))
+		return
+	}
+	export, err := body.export()
+	if err != nil {
+		showErrorStatus(w, historyStatus(err))
+		return
+	}
+	loc, _ := body.location() // Checked by filter.
+
+	var (
+		flusher, _ = w.(http.Flusher)
+		out        = io.Writer(w)
+		gz         *gzip.Writer
+		file       historyWriter
+		started    bool
+		written    int
+	)
+	start := func() error {
+		started = true
+		header := w.Header()
+		header.Set("Content-Type", historyFormats[export.format].contentType)
+		header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": body.filename()}))
+		// Parquet pages are compressed already.
+		if export.format != "parquet" {
+			header.Add("Vary", "Accept-Encoding")
+			if acceptsGzip(rq) {
+				header.Set("Content-Encoding", "gzip")
+				gz = gzip.NewWriter(w)
+				out = gz
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+
+		var err error
+		file, err = newHistoryWriter(out, export, loc)
+		return err
+	}
+	flush := func() error {
+		if err := file.Flush(); err != nil {
+			return err
+		}
+		if gz != nil {
+			if err := gz.Flush(); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	err = h.store.GetHistory(rq.Context(), filter, func(record db.HistoryRecord) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := file.Write(record); err != nil {
+			return err
+		}
+		written++
+		if written%historyFlush == 0 {
+			return flush()
+		}
+		return nil
+	})
+	switch {
+	case err != nil && !started:
+		if _, details := explain(err); details.ErrorId != "" {
+			w.Header().Set("X-Error-Id", details.ErrorId)
+		}
+		showErrorStatus(w, historyStatus(err))
+		return
+	case err != nil:
+		abortStream("History export cut short after %d records: %v\n", written, err)
+	case !started:
+		err = start()
+	}
+
+	if err == nil {
+		err = file.Close()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		abortStream("History export cut short after %d records: %v\n", written, err)
+	}
+}
+
+// acceptsGzip tells if Accept-Encoding lists gzip without q=0.
+func acceptsGzip(rq *http.Request) bool {
+	for _, field := range rq.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(field, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			params = strings.TrimSpace(params)
+			if !strings.HasPrefix(params, "q=") {
+				return true
+			}
+			quality, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64)
+			return err == nil && quality > 0
+		}
+	}
+	return false
+}
+
+func HistoryPost(w http.ResponseWriter, rq *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+
+	var (
+		body    HistoryBody
+		decoder = json.NewDecoder(rq.Body)
+		encoder = json.NewEncoder(w)
+	)
+
+	encoder.SetEscapeHTML(false)
+
+	err := decoder.Decode(&body)
+	if err != nil {
+		failWithHistoryError(badRequest("", err), encoder)
+		return
+	}
+
+	if _, err = body.filter(); err != nil {
+		failWithHistoryError(err, encoder)
+		return
+	}
+	if _, err = body.export(); err != nil {
+		failWithHistoryError(err, encoder)
+		return
+	}
+
+	link := "/history"
+	if query := body.query(); query != "" {
+		link += "?" + query
+	}
+	_ = encoder.Encode(ResponseHistory{Status: "ok", Link: link})
+}
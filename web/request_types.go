@@ -1,5 +1,14 @@
 package web
 
+import (
+	"avito2023/db"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
 type CreateSegmentBody struct {
 	// Name of a new segment. You cannot use a name of a currently or
 	// previously existing segment. The name cannot be an empty string.
@@ -12,6 +21,95 @@ type CreateSegmentBody struct {
 	// upon this request. All new known users will be assigned to this segment
 	// with _percent_% probability.
 	Percent int32 `json:"percent,omitempty"`
+
+	// If true, automatic members are chosen by hash of the salt and the user
+	// id instead of randomly, so that a user always gets the same answer and
+	// clients can compute it. A random salt is made unless one is passed.
+	Deterministic bool `json:"deterministic,omitempty"`
+
+	// Salt for the deterministic mode. Passing it turns the mode on.
+	Salt string `json:"salt,omitempty"`
+
+	// What the segment is for. Optional.
+	Description string `json:"description,omitempty"`
+
+	// Team that owns the segment. Optional.
+	Owner string `json:"owner,omitempty"`
+
+	// Free-form labels. Listings filter by them. Duplicates are ignored,
+	// empty tags are not allowed.
+	Tags []string `json:"tags,omitempty"`
+
+	// Any JSON object. Optional.
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+}
+
+// salt returns the salt for the new segment and makes the body tell it.
+func (body *CreateSegmentBody) salt() (string, error) {
+	if body.Deterministic && body.Salt == "" {
+		salt, err := db.NewSalt()
+		if err != nil {
+			return "", err
+		}
+		body.Salt = salt
+	}
+	body.Deterministic = body.Salt != ""
+	return body.Salt, nil
+}
+
+func (body CreateSegmentBody) meta() db.SegmentMeta {
+	return db.SegmentMeta{
+		Description: body.Description,
+		Owner:       body.Owner,
+		Tags:        body.Tags,
+		Attributes:  body.Attributes,
+	}
+}
+
+// UpdateSegmentBody changes a segment. Fields that are not passed stay as
+// they are. Every change is recorded in the history of the segment.
+type UpdateSegmentBody struct {
+	// Name of the segment to change.
+	Name string `json:"name"`
+
+	// A new automatic percent. When it goes up, known users not in the
+	// segment are added to it to make up the difference. When it goes down,
+	// automatically added users are removed from it. Users who asked for the
+	// segment in update_user stay.
+	Percent *int32 `json:"percent,omitempty"`
+
+	Description *string `json:"description,omitempty"`
+
+	Owner *string `json:"owner,omitempty"`
+
+	// Replaces all the tags.
+	Tags *[]string `json:"tags,omitempty"`
+
+	// Replaces all the attributes.
+	Attributes json.RawMessage `json:"attributes,omitempty"`
+}
+
+func (body UpdateSegmentBody) update() db.SegmentUpdate {
+	return db.SegmentUpdate{
+		Percent:     percent(body.Percent),
+		Description: body.Description,
+		Owner:       body.Owner,
+		Tags:        body.Tags,
+		Attributes:  body.Attributes,
+	}
+}
+
+// PatchSegmentBody is UpdateSegmentBody for v2, where the name is in the path.
+type PatchSegmentBody struct {
+	Percent *int32 `json:"percent,omitempty"`
+
+	Description *string `json:"description,omitempty"`
+
+	Owner *string `json:"owner,omitempty"`
+
+	Tags *[]string `json:"tags,omitempty"`
+
+	Attributes json.RawMessage `json:"attributes,omitempty"`
 }
 
 type DeleteSegmentBody struct {
@@ -21,20 +119,213 @@ type DeleteSegmentBody struct {
 
 type GetSegmentsBody struct {
 	Id int32 `json:"id"`
+	// Also return memberships with details.
+	Verbose bool `json:"verbose,omitempty"`
+	// If set, segments the user was in at that moment. Cannot be used with verbose.
+	AsOf *time.Time `json:"as_of,omitempty"`
+}
+
+// maxBatchUsers is how many users one batch request may ask about.
+const maxBatchUsers = 1000
+
+type GetSegmentsBatchBody struct {
+	// Users to get segments of, at most maxBatchUsers.
+	Ids []int32 `json:"ids"`
+}
+
+func (b GetSegmentsBatchBody) userIds() ([]int, error) {
+	if len(b.Ids) > maxBatchUsers {
+		return nil, badRequest("ids", fmt.Errorf("at most %d ids are allowed", maxBatchUsers))
+	}
+	userIds := make([]int, len(b.Ids))
+	for i, id := range b.Ids {
+		userIds[i] = int(id)
+	}
+	return userIds, nil
+}
+
+type GetScheduledBody struct {
+	Id int32 `json:"id"`
 }
 
+// ExtendRemovalBody moves a planned removal of a user from a segment. Pass
+// either ttl or at.
+type ExtendRemovalBody struct {
+	Id int32 `json:"id"`
+	// Segment to be removed from.
+	Segment string `json:"segment"`
+	// Seconds from now to remove the user after.
+	Ttl int32 `json:"ttl,omitempty"`
+	// When to remove the user. Might be earlier than planned before.
+	At *time.Time `json:"at,omitempty"`
+}
+
+type CancelRemovalBody struct {
+	Id int32 `json:"id"`
+	// Segment to stay in.
+	Segment string `json:"segment"`
+}
+
+// PatchRemovalBody is ExtendRemovalBody for v2, where the id and the segment
+// are in the path.
+type PatchRemovalBody struct {
+	Ttl int32 `json:"ttl,omitempty"`
+
+	At *time.Time `json:"at,omitempty"`
+}
+
+// removalAt returns when to remove the user, given ttl or at.
+func removalAt(ttl int32, at *time.Time) (time.Time, error) {
+	switch {
+	case ttl < 0:
+		return time.Time{}, badRequest("ttl", errors.New("negative ttl"))
+	case ttl > 0 && at != nil:
+		return time.Time{}, badRequest("ttl", errors.New("both ttl and at"))
+	case ttl > 0:
+		return time.Now().Add(time.Duration(ttl) * time.Second), nil
+	case at != nil:
+		return *at, nil
+	}
+	return time.Time{}, badRequest("ttl", errors.New("neither ttl nor at"))
+}
+
+// HistoryBody selects operations for the history file. Fields that are not
+// passed select everything.
 type HistoryBody struct {
+	// A month, in timezone. Cannot be used with from and to.
 	Year int32 `json:"year"`
 
 	Month int32 `json:"month"`
+
+	// Operations at or after from.
+	From *time.Time `json:"from,omitempty"`
+
+	// Operations before to.
+	To *time.Time `json:"to,omitempty"`
+
+	UserId *int32 `json:"user_id,omitempty"`
+
+	Segment string `json:"segment,omitempty"`
+
+	// add or remove.
+	Operation string `json:"operation,omitempty"`
+
+	// IANA name, like Europe/Moscow, for months and stamps in the file. UTC
+	// by default.
+	Timezone string `json:"timezone,omitempty"`
+
+	// csv, tsv, json, ndjson or parquet. Semicolon-separated CSV without a
+	// header by default.
+	Format string `json:"format,omitempty"`
+
+	// Columns of the file in order, all by default.
+	Columns []string `json:"columns,omitempty"`
 }
 
 type UpdateUserBody struct {
 	Id int32 `json:"id"`
 	// Segments to add the user to. Duplicates are ignored. For any given segment, if the user is already part of it, nothing happens and no error is returned.
-	AddToSegments []string `json:"add_to_segments,omitempty"`
+	AddToSegments []SegmentAddition `json:"add_to_segments,omitempty"`
 	// Segments to remove the user from. Duplicates are ignored. For any given segment, if the user is not part of it, nothing happend and no error is returned.
 	RemoveFromSegments []string `json:"remove_from_segments,omitempty"`
 	// Time to live. Seconds to wait before removing the user from all the `add_to_segments` segments.
 	Ttl int32 `json:"ttl,omitempty"`
+	// When to add the user to segments, by segment name.
+	AddAt map[string]time.Time `json:"add_at,omitempty"`
+	// When to remove the user from segments, by segment name.
+	RemoveAt map[string]time.Time `json:"remove_at,omitempty"`
+}
+
+// UpdateUserSegmentsBody is UpdateUserBody for v2, where the id is in the path.
+type UpdateUserSegmentsBody struct {
+	// Segments to add the user to. See UpdateUserBody.
+	AddToSegments []SegmentAddition `json:"add_to_segments,omitempty"`
+	// Segments to remove the user from. See UpdateUserBody.
+	RemoveFromSegments []string `json:"remove_from_segments,omitempty"`
+	// Time to live. Seconds to wait before removing the user from all the `add_to_segments` segments.
+	Ttl int32 `json:"ttl,omitempty"`
+	// When to add the user to segments. See UpdateUserBody.
+	AddAt map[string]time.Time `json:"add_at,omitempty"`
+	// When to remove the user from segments. See UpdateUserBody.
+	RemoveAt map[string]time.Time `json:"remove_at,omitempty"`
+}
+
+// SegmentAddition is an element of add_to_segments: either a segment name, or
+// an object with the name and an expiry of its own.
+type SegmentAddition struct {
+	Name string `json:"name"`
+	// Seconds to wait before removing the user from this segment. Overrides the ttl of the request.
+	Ttl int32 `json:"ttl,omitempty"`
+	// When to remove the user from this segment. Overrides the ttl of the request.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (a *SegmentAddition) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		*a = SegmentAddition{}
+		return json.Unmarshal(data, &a.Name)
+	}
+	type plain SegmentAddition
+	return json.Unmarshal(data, (*plain)(a))
+}
+
+// additions converts add_to_segments into segment names and removals after
+// TTL for segments with an expiry of their own. remove_at wins over such
+// expiries.
+func additions(addTo []SegmentAddition, removeAt map[string]time.Time) ([]string, []db.Plan, error) {
+	var (
+		names    = make([]string, len(addTo))
+		expiries []db.Plan
+		now      = time.Now()
+	)
+	for i, a := range addTo {
+		names[i] = a.Name
+		var at time.Time
+		switch {
+		case a.Ttl < 0:
+			return nil, nil, badRequest("add_to_segments", fmt.Errorf("negative ttl for segment %q", a.Name))
+		case a.Ttl > 0 && a.ExpiresAt != nil:
+			return nil, nil, badRequest("add_to_segments", fmt.Errorf("both ttl and expires_at for segment %q", a.Name))
+		case a.Ttl > 0:
+			at = now.Add(time.Duration(a.Ttl) * time.Second)
+		case a.ExpiresAt != nil:
+			at = *a.ExpiresAt
+		default:
+			continue
+		}
+		if _, ok := removeAt[a.Name]; ok {
+			continue
+		}
+		expiries = append(expiries, db.Plan{Segment: a.Name, Operation: db.OpRemove, At: at, Source: db.SourceTTL})
+	}
+	return names, expiries, nil
+}
+
+// plans converts add_at and remove_at, ordered by segment name so that errors
+// do not depend on map order.
+func plans(addAt, removeAt map[string]time.Time) []db.Plan {
+	var plans []db.Plan
+	for name, at := range addAt {
+		plans = append(plans, db.Plan{Segment: name, Operation: db.OpAdd, At: at})
+	}
+	for name, at := range removeAt {
+		plans = append(plans, db.Plan{Segment: name, Operation: db.OpRemove, At: at})
+	}
+	sort.Slice(plans, func(i, j int) bool {
+		if plans[i].Segment != plans[j].Segment {
+			return plans[i].Segment < plans[j].Segment
+		}
+		return plans[i].Operation < plans[j].Operation
+	})
+	return plans
+}
+
+// percent converts an optional percent. Negative values become too big, so
+// stores reject them.
+func percent(p *int32) *uint {
+	if p == nil {
+		return nil
+	}
+	u := uint(*p)
+	return &u
 }
@@ -1,5 +1,37 @@
 package web
 
+import (
+	"encoding/json"
+	"time"
+)
+
+// ErrorDetails explain errors for programs. Responses have them next to the
+// `error` field, and only when it is set.
+type ErrorDetails struct {
+	// Machine-readable error code. Unlike `error`, it never changes. Values:
+	// * `name_empty`, `name_taken`, `name_free`, `segment_deleted`,
+	//   `bad_percent`, `bad_tag`, `bad_attributes`, `bad_row`, `bad_time`,
+	//   `not_planned` are the same as `error` values with spaces. `bad_row` is
+	//   only for failures of bulk updates.
+	// * `bad_request` means the request is malformed.
+	// * `internal` means something went wrong on our side.
+	Code string `json:"code,omitempty"`
+
+	// Request field at fault, like `add_to_segments`, if any.
+	Field string `json:"field,omitempty"`
+
+	// Name of the segment at fault, if any. For example, the segment from
+	// `add_to_segments` that does not exist.
+	Segment string `json:"segment,omitempty"`
+
+	// Whether the same request might succeed later.
+	Retryable bool `json:"retryable,omitempty"`
+
+	// Set for internal errors. Tell us this id, and we will find the
+	// error in the logs.
+	ErrorId string `json:"error_id,omitempty"`
+}
+
 type ResponseUsual struct {
 	// Status of the operation. If `ok`, then the operation went correctly,
 	// and you can ignore the `error` field. If `error`, an error occurred
@@ -14,8 +46,14 @@ type ResponseUsual struct {
 	// * `name free` means that no segment with the given name exists.
 	// * `segment deleted` means that the segment is segment deleted.
 	// * `bad percent` means the passed percent value is outside 0..100 range.
-	//* Other values are internal or parsing errors.
+	// * `bad tag` means one of the tags is an empty string.
+	// * `bad attributes` means the attributes are not a JSON object.
+	// * `not planned` means the user has no planned removal from the segment.
+	// * `internal error` means something went wrong on our side. See `error_id`.
+	//* Other values are parsing errors.
 	Err string `json:"error,omitempty"`
+
+	ErrorDetails
 }
 
 type ResponseGetSegments struct {
@@ -23,7 +61,68 @@ type ResponseGetSegments struct {
 
 	Err string `json:"error,omitempty"`
 
+	ErrorDetails
+
 	Segments []string `json:"segments,omitempty"`
+
+	// Only if verbose.
+	Memberships []Membership `json:"memberships,omitempty"`
+}
+
+type ResponseGetSegmentsBatch struct {
+	Status string `json:"status"`
+
+	Err string `json:"error,omitempty"`
+
+	ErrorDetails
+
+	// Segments by user id. Every requested user is there.
+	Users map[int][]string `json:"users,omitempty"`
+}
+
+type ResponseUpdateUsers struct {
+	Status string `json:"status"`
+
+	Err string `json:"error,omitempty"`
+
+	ErrorDetails
+
+	*BulkResult
+}
+
+// BulkResult reports how a bulk update went.
+type BulkResult struct {
+	// Rows read.
+	Rows int `json:"rows"`
+
+	// Rows applied. The rest failed.
+	Applied int `json:"applied"`
+
+	// Rows failed.
+	Failed int `json:"failed"`
+
+	// At most the first 1000 failures, ordered by line.
+	Failures []BulkFailure `json:"failures"`
+}
+
+// BulkFailure is a row of a bulk update that was not applied.
+type BulkFailure struct {
+	// Line of the input where the row starts.
+	Line int `json:"line"`
+
+	Err string `json:"error"`
+
+	ErrorDetails
+}
+
+type ResponseGetScheduled struct {
+	Status string `json:"status"`
+
+	Err string `json:"error,omitempty"`
+
+	ErrorDetails
+
+	Scheduled []ScheduledOperation `json:"scheduled,omitempty"`
 }
 
 type ResponseHistory struct {
@@ -31,10 +130,155 @@ type ResponseHistory struct {
 
 	// Set if `status` is `error`. Possible values:
 	// * `bad time` means the year or month you passed is invalid in general.
-	// * Other values are internal or parsing errors.
+	// * `internal error` means something went wrong on our side. See `error_id`.
+	// * Other values are parsing errors.
 	Err string `json:"error,omitempty"`
 
+	ErrorDetails
+
 	// If `status` is `ok`, link starts with /. Request the file at the same
 	// server. If `error`, this string is empty.
 	Link string `json:"link,omitempty"`
 }
+
+// ResponseError is the body of every v2 response with status code 400 and
+// above. See ResponseUsual for possible values.
+type ResponseError struct {
+	Err string `json:"error"`
+
+	ErrorDetails
+}
+
+type ResponseUserSegments struct {
+	Segments []string `json:"segments"`
+
+	// Only if verbose.
+	Memberships []Membership `json:"memberships,omitempty"`
+}
+
+type Membership struct {
+	Segment string `json:"segment"`
+
+	// explicit, automatic or ttl.
+	Source string `json:"source"`
+
+	// Unset if the user joined before it was recorded.
+	JoinedAt *time.Time `json:"joined_at,omitempty"`
+
+	// When the TTL runs out. Unset if never.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ResponseScheduled is ResponseGetScheduled for v2.
+type ResponseScheduled struct {
+	Scheduled []ScheduledOperation `json:"scheduled"`
+}
+
+// ScheduledOperation is an operation planned for later.
+type ScheduledOperation struct {
+	Segment string `json:"segment"`
+
+	// add or remove.
+	Operation string `json:"operation"`
+
+	At time.Time `json:"at"`
+
+	// How the operation will be recorded in the history: ttl for removals
+	// after TTL, explicit for the rest.
+	Source string `json:"source"`
+}
+
+// ResponseUsersSegments is ResponseGetSegmentsBatch for v2.
+type ResponseUsersSegments struct {
+	Users map[int][]string `json:"users"`
+}
+
+type SegmentInfo struct {
+	Id int `json:"id"`
+
+	Name string `json:"name"`
+
+	AutomaticPercent uint `json:"automatic_percent"`
+
+	Deleted bool `json:"deleted"`
+
+	// Set if automatic members are chosen by hash rather than randomly. See
+	// the deterministic mode of /create_segment.
+	Salt string `json:"salt,omitempty"`
+
+	// Missing for segments created before the service recorded it.
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+
+	// Missing for active segments and ones deleted before the service
+	// recorded it.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+
+	Description string `json:"description"`
+
+	Owner string `json:"owner"`
+
+	Tags []string `json:"tags"`
+
+	// JSON object, `{}` if not set.
+	Attributes json.RawMessage `json:"attributes"`
+
+	// Number of users in the segment now.
+	Members int `json:"members"`
+
+	// Number of users to be removed from the segment when their TTL runs out.
+	PendingRemovals int `json:"pending_removals"`
+}
+
+type ResponseSegmentList struct {
+	Segments []SegmentInfo `json:"segments"`
+
+	// Set if there might be more segments. Pass it as `after` to get them.
+	NextAfter int `json:"next_after,omitempty"`
+}
+
+type ResponseSegmentUsers struct {
+	Users []int `json:"users"`
+
+	// Set if there might be more users. Pass it as `after` to get them.
+	NextAfter *int `json:"next_after,omitempty"`
+}
+
+type ResponseSegmentRemovals struct {
+	Removals []Removal `json:"removals"`
+
+	// Set if there might be more removals. Pass its at and user_id as
+	// after_at and after_user_id to get them.
+	NextAfter *Removal `json:"next_after,omitempty"`
+}
+
+// Removal is a planned removal of a user from a segment.
+type Removal struct {
+	UserId int `json:"user_id"`
+
+	At time.Time `json:"at"`
+
+	// ttl for removals after TTL, explicit for the rest.
+	Source string `json:"source"`
+}
+
+type ResponseCount struct {
+	Count int `json:"count"`
+}
+
+// SegmentChange is a change of one field of a segment.
+type SegmentChange struct {
+	Stamp time.Time `json:"stamp"`
+
+	// One of `automatic_percent`, `description`, `owner`, `tags`, `attributes`.
+	Field string `json:"field"`
+
+	// The value before the change.
+	Old json.RawMessage `json:"old"`
+
+	// The value after the change.
+	New json.RawMessage `json:"new"`
+}
+
+type ResponseSegmentHistory struct {
+	Changes []SegmentChange `json:"changes"`
+}
@@ -1,6 +1,7 @@
 package web
 
 import (
+	"avito2023/db"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
@@ -30,19 +31,36 @@ func logger(inner http.Handler, name string) http.Handler {
 	})
 }
 
-var routes = []route{
-	{"Index", "GET", "/", index},
-	{"CreateSegmentPost", "POST", "/create_segment", CreateSegmentPost},
-	{"DeleteSegmentPost", "POST", "/delete_segment", DeleteSegmentPost},
-	{"GetSegmentsPost", "POST", "/get_segments", GetSegmentsPost},
-	{"UpdateUserPost", "POST", "/update_user", UpdateUserPost},
-	{"HistoryGet", "GET", "/history", HistoryGet},
-	{"HistoryPost", "POST", "/history", HistoryPost},
+func (h *handlers) routes() []route {
+	return []route{
+		{"Index", "GET", "/", index},
+		{"CreateSegmentPost", "POST", "/create_segment", h.CreateSegmentPost},
+		{"UpdateSegmentPost", "POST", "/update_segment", h.UpdateSegmentPost},
+		{"DeleteSegmentPost", "POST", "/delete_segment", h.DeleteSegmentPost},
+		{"GetSegmentsPost", "POST", "/get_segments", h.GetSegmentsPost},
+		{"GetSegmentsBatchPost", "POST", "/get_segments_batch", h.GetSegmentsBatchPost},
+		{"UpdateUserPost", "POST", "/update_user", h.UpdateUserPost},
+		{"GetScheduledPost", "POST", "/get_scheduled", h.GetScheduledPost},
+		{"ExtendRemovalPost", "POST", "/extend_removal", h.ExtendRemovalPost},
+		{"CancelRemovalPost", "POST", "/cancel_removal", h.CancelRemovalPost},
+		{"UpdateUsersPost", "POST", "/update_users", h.UpdateUsersPost},
+		{"HistoryGet", "GET", "/history", h.HistoryGet},
+		{"HistoryPost", "POST", "/history", HistoryPost},
+		{"SegmentsGet", "GET", "/segments", h.SegmentsGet},
+		{"SegmentGet", "GET", "/segments/{name}", h.SegmentGet},
+		{"SegmentUsersGet", "GET", "/segments/{name}/users", h.SegmentUsersGet},
+		{"SegmentHistoryGet", "GET", "/segments/{name}/history", h.SegmentHistoryGet},
+		{"SegmentRemovalsGet", "GET", "/segments/{name}/removals", h.SegmentRemovalsGet},
+	}
 }
 
-func NewRouter() *mux.Router {
-	router := mux.NewRouter().StrictSlash(true)
-	for _, route := range routes {
+func NewRouter(store db.SegmentStore) *mux.Router {
+	var (
+		h = &handlers{store: store}
+		// Encoded paths let segment names have slashes.
+		router = mux.NewRouter().StrictSlash(true).UseEncodedPath()
+	)
+	for _, route := range append(h.routes(), h.routesV2()...) {
 		router.
 			Methods(route.Method).
 			Path(route.Pattern).
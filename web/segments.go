@@ -0,0 +1,405 @@
+package web
+
+import (
+	"avito2023/db"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+
+	// Users are smaller than segments, so pages are bigger.
+	defaultMemberLimit = 1000
+	maxMemberLimit     = 10_000
+
+	// Streamed responses are flushed every this many users.
+	memberFlush = 1000
+)
+
+// SegmentsGet lists segments. See swagger.yml for the query parameters.
+func (h *handlers) SegmentsGet(w http.ResponseWriter, rq *http.Request) {
+	filter, err := segmentFilter(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	segments, err := h.store.ListSegments(rq.Context(), filter)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	response := ResponseSegmentList{Segments: []SegmentInfo{}}
+	for _, info := range segments {
+		response.Segments = append(response.Segments, segmentInfo(info))
+	}
+	if len(segments) == filter.Limit {
+		response.NextAfter = segments[len(segments)-1].Id
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// SegmentGet describes one segment, deleted or not.
+func (h *handlers) SegmentGet(w http.ResponseWriter, rq *http.Request) {
+	name, err := pathSegmentName(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	info, err := h.store.InspectSegment(rq.Context(), name)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, segmentInfo(info))
+}
+
+// segmentFilter parses query parameters of SegmentsGet.
+func segmentFilter(rq *http.Request) (db.SegmentFilter, error) {
+	var (
+		query  = rq.URL.Query()
+		filter = db.SegmentFilter{
+			Prefix: query.Get("prefix"),
+			Tag:    query.Get("tag"),
+			Limit:  defaultListLimit,
+		}
+		err error
+	)
+
+	switch query.Get("state") {
+	case "", "all":
+	case "active":
+		deleted := false
+		filter.Deleted = &deleted
+	case "deleted":
+		deleted := true
+		filter.Deleted = &deleted
+	default:
+		return filter, badRequest("state", errors.New("state is not one of active, deleted, all"))
+	}
+
+	if s := query.Get("limit"); s != "" {
+		filter.Limit, err = strconv.Atoi(s)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxListLimit {
+			return filter, badRequest("limit", fmt.Errorf("limit is not in 1..%d", maxListLimit))
+		}
+	}
+
+	if s := query.Get("after"); s != "" {
+		filter.After, err = strconv.Atoi(s)
+		if err != nil || filter.After < 0 {
+			return filter, badRequest("after", errors.New("bad segment id"))
+		}
+	}
+	return filter, nil
+}
+
+func segmentInfo(info db.SegmentInfo) SegmentInfo {
+	response := SegmentInfo{
+		Id:               info.Id,
+		Name:             info.Name,
+		AutomaticPercent: info.AutomaticPercent,
+		Deleted:          info.Deleted,
+		Salt:             info.Salt,
+		Description:      info.Description,
+		Owner:            info.Owner,
+		Tags:             info.Tags,
+		Attributes:       info.Attributes,
+		Members:          info.Members,
+		PendingRemovals:  info.PendingRemovals,
+	}
+	if !info.CreatedAt.IsZero() {
+		response.CreatedAt = timePtr(info.CreatedAt)
+	}
+	if !info.DeletedAt.IsZero() {
+		response.DeletedAt = timePtr(info.DeletedAt)
+	}
+	return response
+}
+
+func timePtr(t time.Time) *time.Time {
+	t = t.UTC()
+	return &t
+}
+
+// SegmentHistoryGet lists changes of a segment, deleted or not.
+func (h *handlers) SegmentHistoryGet(w http.ResponseWriter, rq *http.Request) {
+	name, err := pathSegmentName(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	changes, err := h.store.SegmentChanges(rq.Context(), name)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	response := ResponseSegmentHistory{Changes: []SegmentChange{}}
+	for _, change := range changes {
+		response.Changes = append(response.Changes, SegmentChange{
+			Stamp: change.Stamp.UTC(),
+			Field: change.Field,
+			Old:   change.Old,
+			New:   change.New,
+		})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// SegmentRemovalsGet lists a page of planned removals from a segment,
+// earliest first.
+func (h *handlers) SegmentRemovalsGet(w http.ResponseWriter, rq *http.Request) {
+	name, err := pathSegmentName(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	filter, err := removalFilter(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	response := ResponseSegmentRemovals{Removals: []Removal{}}
+	err = h.store.ListRemovals(rq.Context(), name, filter, func(removal db.Removal) error {
+		response.Removals = append(response.Removals, Removal{
+			UserId: removal.UserId,
+			At:     removal.At.UTC(),
+			Source: removal.Source,
+		})
+		return nil
+	})
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	if len(response.Removals) == filter.Limit {
+		response.NextAfter = &response.Removals[len(response.Removals)-1]
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// removalFilter parses query parameters of SegmentRemovalsGet. Pages are as
+// big as pages of users.
+func removalFilter(rq *http.Request) (db.RemovalFilter, error) {
+	var (
+		query  = rq.URL.Query()
+		filter = db.RemovalFilter{Limit: defaultMemberLimit}
+	)
+
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > maxMemberLimit {
+			return filter, badRequest("limit", fmt.Errorf("limit is not in 1..%d", maxMemberLimit))
+		}
+		filter.Limit = limit
+	}
+
+	afterAt, afterUserId := query.Get("after_at"), query.Get("after_user_id")
+	if afterAt == "" && afterUserId == "" {
+		return filter, nil
+	}
+	at, err := time.Parse(time.RFC3339, afterAt)
+	if err != nil {
+		return filter, badRequest("after_at", err)
+	}
+	userId, err := strconv.Atoi(afterUserId)
+	if err != nil {
+		return filter, badRequest("after_user_id", errors.New("bad user id"))
+	}
+	filter.After = &db.Removal{UserId: userId, At: at}
+	return filter, nil
+}
+
+// SegmentUsersGet lists users in a segment. A page comes as JSON, but the
+// ndjson and csv formats stream every user unless limited. With count=true
+// only the number of users is returned.
+func (h *handlers) SegmentUsersGet(w http.ResponseWriter, rq *http.Request) {
+	name, err := pathSegmentName(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	var (
+		query  = rq.URL.Query()
+		format = query.Get("format")
+	)
+	if s := query.Get("count"); s != "" {
+		count, err := strconv.ParseBool(s)
+		if err != nil {
+			fail(w, badRequest("count", err))
+			return
+		}
+		if count {
+			asOf, err := queryAsOf(rq)
+			if err != nil {
+				fail(w, err)
+				return
+			}
+			h.segmentUsersCount(w, rq, name, asOf)
+			return
+		}
+	}
+
+	filter, err := memberFilter(rq, format == "" || format == "json")
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	switch format {
+	case "", "json":
+		h.segmentUsersPage(w, rq, name, filter)
+	case "ndjson", "csv":
+		h.segmentUsersStream(w, rq, name, filter, format)
+	default:
+		fail(w, badRequest("format", errors.New("format is not one of json, ndjson, csv")))
+	}
+}
+
+func (h *handlers) segmentUsersCount(w http.ResponseWriter, rq *http.Request, name string, asOf *time.Time) {
+	if asOf == nil {
+		info, err := h.store.InspectSegment(rq.Context(), name)
+		if err != nil {
+			fail(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, ResponseCount{Count: info.Members})
+		return
+	}
+
+	// Past members are not counted anywhere, so replay them.
+	var response ResponseCount
+	err := h.store.ListMembers(rq.Context(), name, db.MemberFilter{AsOf: asOf}, func(int) error {
+		response.Count++
+		return nil
+	})
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (h *handlers) segmentUsersPage(w http.ResponseWriter, rq *http.Request, name string, filter db.MemberFilter) {
+	response := ResponseSegmentUsers{Users: []int{}}
+	err := h.store.ListMembers(rq.Context(), name, filter, func(userId int) error {
+		response.Users = append(response.Users, userId)
+		return nil
+	})
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	if len(response.Users) == filter.Limit {
+		response.NextAfter = &response.Users[len(response.Users)-1]
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// segmentUsersStream writes users as they come from the store. Headers are
+// sent with the first user, so errors before it get a proper response. Errors
+// after it abort the connection, like in HistoryGet.
+func (h *handlers) segmentUsersStream(w http.ResponseWriter, rq *http.Request, name string, filter db.MemberFilter, format string) {
+	var (
+		flusher, _ = w.(http.Flusher)
+		started    bool
+		written    int
+		line       []byte
+	)
+	start := func() error {
+		started = true
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+			w.WriteHeader(http.StatusOK)
+			_, err := io.WriteString(w, "user_id\n")
+			return err
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	err := h.store.ListMembers(rq.Context(), name, filter, func(userId int) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+
+		line = line[:0]
+		if format == "csv" {
+			line = strconv.AppendInt(line, int64(userId), 10)
+		} else {
+			line = append(line, `{"user_id":`...)
+			line = strconv.AppendInt(line, int64(userId), 10)
+			line = append(line, '}')
+		}
+		line = append(line, '\n')
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+
+		written++
+		if flusher != nil && written%memberFlush == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	switch {
+	case err != nil && !started:
+		fail(w, err)
+	case err != nil:
+		abortStream("Listing users of %q cut short after %d: %v\n", name, written, err)
+	case !started:
+		if err = start(); err != nil {
+			abortStream("Listing users of %q cut short: %v\n", name, err)
+		}
+	}
+}
+
+// memberFilter parses query parameters of SegmentUsersGet. Pages are limited,
+// streams are not unless asked.
+func memberFilter(rq *http.Request, paged bool) (db.MemberFilter, error) {
+	var (
+		query  = rq.URL.Query()
+		filter db.MemberFilter
+	)
+
+	if paged {
+		filter.Limit = defaultMemberLimit
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || (paged && limit > maxMemberLimit) {
+			return filter, badRequest("limit", fmt.Errorf("limit is not in 1..%d", maxMemberLimit))
+		}
+		filter.Limit = limit
+	}
+
+	if s := query.Get("after"); s != "" {
+		after, err := strconv.Atoi(s)
+		if err != nil {
+			return filter, badRequest("after", errors.New("bad user id"))
+		}
+		filter.After = &after
+	}
+
+	asOf, err := queryAsOf(rq)
+	if err != nil {
+		return filter, err
+	}
+	filter.AsOf = asOf
+	return filter, nil
+}
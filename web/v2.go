@@ -0,0 +1,315 @@
+package web
+
+import (
+	"avito2023/db"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The v2 API names resources in paths and reports errors with HTTP status
+// codes. Successful responses carry no status field.
+
+func (h *handlers) routesV2() []route {
+	return []route{
+		{"SegmentsPostV2", "POST", "/v2/segments", h.SegmentsPostV2},
+		{"SegmentsGetV2", "GET", "/v2/segments", h.SegmentsGet},
+		{"SegmentGetV2", "GET", "/v2/segments/{name}", h.SegmentGet},
+		{"SegmentUsersGetV2", "GET", "/v2/segments/{name}/users", h.SegmentUsersGet},
+		{"SegmentPatchV2", "PATCH", "/v2/segments/{name}", h.SegmentPatchV2},
+		{"SegmentDeleteV2", "DELETE", "/v2/segments/{name}", h.SegmentDeleteV2},
+		{"SegmentHistoryGetV2", "GET", "/v2/segments/{name}/history", h.SegmentHistoryGet},
+		{"UsersSegmentsPostV2", "POST", "/v2/users/segments", h.UsersSegmentsPostV2},
+		{"UsersSegmentsPatchV2", "PATCH", "/v2/users/segments", h.UsersSegmentsPatchV2},
+		{"UserSegmentsGetV2", "GET", "/v2/users/{id}/segments", h.UserSegmentsGetV2},
+		{"UserSegmentsPatchV2", "PATCH", "/v2/users/{id}/segments", h.UserSegmentsPatchV2},
+		{"UserScheduledGetV2", "GET", "/v2/users/{id}/scheduled", h.UserScheduledGetV2},
+		{"SegmentRemovalsGetV2", "GET", "/v2/segments/{name}/removals", h.SegmentRemovalsGet},
+		{"UserRemovalPatchV2", "PATCH", "/v2/users/{id}/removals/{name}", h.UserRemovalPatchV2},
+		{"UserRemovalDeleteV2", "DELETE", "/v2/users/{id}/removals/{name}", h.UserRemovalDeleteV2},
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, response any) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(response); err != nil {
+		log.Println(err)
+	}
+}
+
+// pathUserId returns the {id} path variable.
+func pathUserId(rq *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(rq)["id"])
+	if err != nil {
+		return 0, badRequest("id", errors.New("bad user id"))
+	}
+	return id, nil
+}
+
+// Memberships in the past have no details.
+var errVerboseAsOf = errors.New("as_of cannot be used with verbose")
+
+// queryAsOf returns the as_of query parameter, nil if not passed.
+func queryAsOf(rq *http.Request) (*time.Time, error) {
+	s := rq.URL.Query().Get("as_of")
+	if s == "" {
+		return nil, nil
+	}
+	asOf, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, badRequest("as_of", err)
+	}
+	return &asOf, nil
+}
+
+// pathSegmentName returns the {name} path variable. The router keeps paths
+// encoded so that names can have slashes.
+func pathSegmentName(rq *http.Request) (string, error) {
+	name, err := url.PathUnescape(mux.Vars(rq)["name"])
+	if err != nil {
+		return "", badRequest("name", err)
+	}
+	return name, nil
+}
+
+func (h *handlers) SegmentsPostV2(w http.ResponseWriter, rq *http.Request) {
+	var body CreateSegmentBody
+	if err := json.NewDecoder(rq.Body).Decode(&body); err != nil {
+		fail(w, badRequest("", err))
+		return
+	}
+
+	salt, err := body.salt()
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	if err = h.store.CreateSegment(rq.Context(), body.Name, uint(body.Percent), salt, body.meta()); err != nil {
+		fail(w, err)
+		return
+	}
+
+	// The store normalizes metadata, so show what it keeps.
+	info, err := h.store.InspectSegment(rq.Context(), body.Name)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, segmentInfo(info))
+}
+
+func (h *handlers) SegmentPatchV2(w http.ResponseWriter, rq *http.Request) {
+	name, err := pathSegmentName(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	var body PatchSegmentBody
+	if err = json.NewDecoder(rq.Body).Decode(&body); err != nil {
+		fail(w, badRequest("", err))
+		return
+	}
+
+	update := db.SegmentUpdate{
+		Percent:     percent(body.Percent),
+		Description: body.Description,
+		Owner:       body.Owner,
+		Tags:        body.Tags,
+		Attributes:  body.Attributes,
+	}
+	if err = h.store.UpdateSegment(rq.Context(), name, update); err != nil {
+		fail(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handlers) SegmentDeleteV2(w http.ResponseWriter, rq *http.Request) {
+	name, err := pathSegmentName(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	if err = h.store.DeleteSegment(rq.Context(), name); err != nil {
+		fail(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handlers) UserSegmentsGetV2(w http.ResponseWriter, rq *http.Request) {
+	id, err := pathUserId(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	var verbose bool
+	if s := rq.URL.Query().Get("verbose"); s != "" {
+		if verbose, err = strconv.ParseBool(s); err != nil {
+			fail(w, badRequest("verbose", err))
+			return
+		}
+	}
+
+	asOf, err := queryAsOf(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	var response ResponseUserSegments
+	switch {
+	case asOf != nil && verbose:
+		err = badRequest("as_of", errVerboseAsOf)
+	case asOf != nil:
+		response.Segments, err = h.store.GetSegmentsAsOf(rq.Context(), id, *asOf)
+	case verbose:
+		var memberships []db.Membership
+		memberships, err = h.store.GetMemberships(rq.Context(), id)
+		response.Segments, response.Memberships = membershipsOf(memberships)
+	default:
+		response.Segments, err = h.store.GetSegments(rq.Context(), id)
+	}
+	if err != nil {
+		fail(w, err)
+		return
+	}
+	if response.Segments == nil {
+		response.Segments = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// UsersSegmentsPostV2 gets segments of many users. It is POST only because
+// ids would not fit in a URL.
+func (h *handlers) UsersSegmentsPostV2(w http.ResponseWriter, rq *http.Request) {
+	var body GetSegmentsBatchBody
+	if err := json.NewDecoder(rq.Body).Decode(&body); err != nil {
+		fail(w, badRequest("", err))
+		return
+	}
+
+	userIds, err := body.userIds()
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	users, err := h.store.GetSegmentsBatch(rq.Context(), userIds)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ResponseUsersSegments{Users: users})
+}
+
+func (h *handlers) UserScheduledGetV2(w http.ResponseWriter, rq *http.Request) {
+	id, err := pathUserId(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	plans, err := h.store.GetPlans(rq.Context(), id)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ResponseScheduled{Scheduled: scheduledOperations(plans)})
+}
+
+func (h *handlers) UserSegmentsPatchV2(w http.ResponseWriter, rq *http.Request) {
+	id, err := pathUserId(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	var body UpdateUserSegmentsBody
+	if err = json.NewDecoder(rq.Body).Decode(&body); err != nil {
+		fail(w, badRequest("", err))
+		return
+	}
+
+	addTo, expiries, err := additions(body.AddToSegments, body.RemoveAt)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	err = h.store.UpdateUser(rq.Context(), id, addTo, body.RemoveFromSegments, int(body.Ttl),
+		append(expiries, plans(body.AddAt, body.RemoveAt)...)...)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pathRemoval returns the {id} and {name} path variables of a removal.
+func pathRemoval(rq *http.Request) (int, string, error) {
+	id, err := pathUserId(rq)
+	if err != nil {
+		return 0, "", err
+	}
+	name, err := pathSegmentName(rq)
+	return id, name, err
+}
+
+func (h *handlers) UserRemovalPatchV2(w http.ResponseWriter, rq *http.Request) {
+	id, name, err := pathRemoval(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	var body PatchRemovalBody
+	if err = json.NewDecoder(rq.Body).Decode(&body); err != nil {
+		fail(w, badRequest("", err))
+		return
+	}
+	at, err := removalAt(body.Ttl, body.At)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	if err = h.store.ExtendRemoval(rq.Context(), id, name, at); err != nil {
+		fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handlers) UserRemovalDeleteV2(w http.ResponseWriter, rq *http.Request) {
+	id, name, err := pathRemoval(rq)
+	if err != nil {
+		fail(w, err)
+		return
+	}
+
+	if err = h.store.CancelRemoval(rq.Context(), id, name); err != nil {
+		fail(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}